@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// userDB maps user names to passwords. It is shared by HTTP Basic proxy
+// authentication and SOCKS5 username/password authentication.
+type userDB map[string]string
+
+// loadUsers reads one "username:password" pair per line. Empty lines and
+// lines starting with '#' are ignored.
+func loadUsers(path string) (userDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(userDB)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, found := strings.Cut(line, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("line %d: expect username:password", n)
+		}
+		users[username] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (users userDB) verify(username, password string) bool {
+	expected, ok := users[username]
+	if !ok {
+		// still compare so that unknown users take as long as known ones
+		expected = password + "\x00"
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// verifyBasicAuthorization checks the value of a Proxy-Authorization or
+// Authorization header using the "Basic" scheme.
+func (users userDB) verifyBasicAuthorization(header string) bool {
+	scheme, credentials, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return false
+	}
+	return users.verify(username, password)
+}
+
+// accessList decides which clients may use the local proxy. A client is
+// denied if it matches any deny entry, or if allow entries exist and it
+// matches none of them.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAccessList(allow, deny []string) (*accessList, error) {
+	var err error
+	l := &accessList{}
+	if l.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if l.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseCIDRs accepts CIDR blocks as well as single IP addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (l *accessList) allowed(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, n := range l.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessListener drops the connections of clients denied by the access
+// list of the local proxy as soon as they are accepted, before anything they
+// send is parsed.
+type accessListener struct {
+	net.Listener
+	proxy localProxyProvider
+}
+
+func newAccessListener(listener net.Listener, proxy localProxyProvider) *accessListener {
+	return &accessListener{Listener: listener, proxy: proxy}
+}
+
+func (l *accessListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.proxy.current().accessList.allowedAddr(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		log.Printf("deny client %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// allowedAddr is like allowed but takes a remote address such as
+// net.Conn.RemoteAddr().String() or http.Request.RemoteAddr.
+func (l *accessList) allowedAddr(addr string) bool {
+	if l == nil {
+		return true
+	}
+	return l.allowed(addrIP(addr))
+}
+
+// addrIP returns the IP of an address in the form host:port, or nil.
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	require.Nil(t, os.WriteFile(path, []byte("# users\nalice:secret\nbob:p:a:ss\n"), 0600))
+
+	users, err := loadUsers(path)
+	require.Nil(t, err)
+	require.True(t, users.verify("alice", "secret"))
+	require.True(t, users.verify("bob", "p:a:ss"))
+	require.False(t, users.verify("alice", "wrong"))
+	require.False(t, users.verify("carol", ""))
+
+	require.Nil(t, os.WriteFile(path, []byte("alice\n"), 0600))
+	_, err = loadUsers(path)
+	require.NotNil(t, err)
+}
+
+func TestAccessList(t *testing.T) {
+	l, err := newAccessList([]string{"192.168.0.0/16", "::1"}, []string{"192.168.1.100"})
+	require.Nil(t, err)
+
+	require.True(t, l.allowed(net.ParseIP("192.168.1.1")))
+	require.True(t, l.allowed(net.ParseIP("::1")))
+	require.False(t, l.allowed(net.ParseIP("192.168.1.100")))
+	require.False(t, l.allowed(net.ParseIP("10.0.0.1")))
+	require.True(t, l.allowedAddr("192.168.1.1:5000"))
+	require.False(t, l.allowedAddr("[2001:db8::1]:5000"))
+
+	open, err := newAccessList(nil, []string{"10.0.0.0/8"})
+	require.Nil(t, err)
+	require.True(t, open.allowed(net.ParseIP("192.168.1.1")))
+	require.False(t, open.allowed(net.ParseIP("10.1.1.1")))
+
+	var none *accessList
+	require.True(t, none.allowedAddr("10.1.1.1:80"))
+
+	_, err = newAccessList([]string{"not an ip"}, nil)
+	require.NotNil(t, err)
+}
+
+func TestLocalProxyAuthentication(t *testing.T) {
+	proxy := &localProxyServer{users: userDB{"alice": "secret"}}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://www.example.com:443", nil)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	require.Equal(t, `Basic realm="sandwich"`, rw.Header().Get("Proxy-Authenticate"))
+
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wrong")))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+}
+
+func TestLocalProxyDeniesClient(t *testing.T) {
+	l, _ := newAccessList([]string{"10.0.0.0/8"}, nil)
+	proxy := &localProxyServer{accessList: l}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://www.example.com:443", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestMixedListenerDeniesClients(t *testing.T) {
+	l, _ := newAccessList(nil, []string{"127.0.0.0/8"})
+	proxy := &localProxyServer{accessList: l}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	mixed := newMixedListener(listener, proxy, &socks4Server{proxy: proxy}, &socks5Server{proxy: proxy})
+	defer mixed.Close()
+	go http.Serve(mixed, proxy)
+
+	// SOCKS clients are closed without a reply
+	conn, err := net.Dial("tcp", mixed.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// HTTP clients are answered 403
+	conn, err = net.Dial("tcp", mixed.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestAccessListenerDropsDeniedClients(t *testing.T) {
+	l, _ := newAccessList(nil, []string{"127.0.0.0/8"})
+	proxy := &reloadableLocalProxy{}
+	proxy.Store(&localProxyServer{accessList: l})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := newAccessListener(listener, proxy).Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	select {
+	case <-accepted:
+		t.Fatal("denied client accepted")
+	default:
+	}
+
+	l, _ = newAccessList([]string{"127.0.0.0/8"}, nil)
+	proxy.Store(&localProxyServer{accessList: l})
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("allowed client not accepted")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxBlockedDomainCounters bounds the number of domains counted one by one,
+// blocked requests to further domains only add to the totals.
+const maxBlockedDomainCounters = 1024
+
+// errBlocked is returned by localProxyServer.connect for ad and tracker
+// domains in the block list.
+var errBlocked = errors.New("blocked by block list")
+
+// blockList refuses ad and tracker domains listed in hosts files or
+// AdGuard/AdBlock style filter lists, before any DNS lookup is made.
+type blockList struct {
+	locations []string
+	client    *http.Client
+
+	sync.RWMutex
+	domains *domainMatcher
+	ready   bool
+
+	proxyBlocked atomic.Uint64
+	dnsBlocked   atomic.Uint64
+
+	countersMu sync.Mutex
+	counters   map[string]uint64
+}
+
+func newBlockList(locations []string, client *http.Client) *blockList {
+	return &blockList{
+		locations: locations,
+		client:    client,
+		counters:  make(map[string]uint64),
+	}
+}
+
+// update fetches every list again and swaps in the merged result.
+func (l *blockList) update(ctx context.Context) error {
+	domains := newDomainMatcher()
+	for _, location := range l.locations {
+		data, err := fetchList(ctx, l.client, location)
+		if err != nil {
+			return fmt.Errorf("fetch block list %s error: %v", location, err)
+		}
+		parseBlockList(data, domains)
+	}
+
+	l.Lock()
+	l.domains = domains
+	l.ready = true
+	l.Unlock()
+	return nil
+}
+
+// loaded reports whether the lists have been loaded once.
+func (l *blockList) loaded() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.ready
+}
+
+// fromURL reports whether any of the lists is fetched from an http(s) URL.
+func (l *blockList) fromURL() bool {
+	for _, location := range l.locations {
+		if isListURL(location) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeOver uses the domains prev has loaded from the same lists, so that a
+// reload does not let blocked domains through while they are fetched again.
+func (l *blockList) takeOver(prev *blockList) {
+	if !slices.Equal(prev.locations, l.locations) {
+		return
+	}
+	prev.RLock()
+	domains, ready := prev.domains, prev.ready
+	prev.RUnlock()
+
+	l.Lock()
+	l.domains = domains
+	l.ready = ready
+	l.Unlock()
+}
+
+// blocked reports whether host is blocked and counts it if so. via is
+// either "proxy" or "dns". A nil blockList blocks nothing.
+func (l *blockList) blocked(host, via string) bool {
+	if l == nil {
+		return false
+	}
+	l.RLock()
+	blocked := l.domains.match(host)
+	l.RUnlock()
+	if !blocked {
+		return false
+	}
+
+	if via == "dns" {
+		l.dnsBlocked.Add(1)
+	} else {
+		l.proxyBlocked.Add(1)
+	}
+	host = normalizeDomain(host)
+	l.countersMu.Lock()
+	if _, ok := l.counters[host]; ok || len(l.counters) < maxBlockedDomainCounters {
+		l.counters[host]++
+	}
+	l.countersMu.Unlock()
+	return true
+}
+
+type blockListStats struct {
+	Proxy   uint64            `json:"proxy"`
+	DNS     uint64            `json:"dns"`
+	Domains map[string]uint64 `json:"domains"`
+}
+
+func (l *blockList) stats() blockListStats {
+	s := blockListStats{
+		Proxy:   l.proxyBlocked.Load(),
+		DNS:     l.dnsBlocked.Load(),
+		Domains: make(map[string]uint64),
+	}
+	l.countersMu.Lock()
+	for domain, n := range l.counters {
+		s.Domains[domain] = n
+	}
+	l.countersMu.Unlock()
+	return s
+}
+
+// parseBlockList adds the domains of a hosts file or an AdGuard/AdBlock
+// filter list to m. Hosts entries block exactly the named host, "||domain^"
+// filters block the domain and its subdomains, and "@@||domain^" filters
+// unblock them. Filters on URL paths, cosmetic filters and filters with
+// options cannot be applied to a connection and are skipped.
+func parseBlockList(data []byte, m *domainMatcher) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			for _, host := range fields[1:] {
+				if host = normalizeDomain(host); isBlockableHost(host) {
+					m.full[host] = struct{}{}
+				}
+			}
+			continue
+		}
+
+		set := m.suffixes
+		if strings.HasPrefix(line, "@@") {
+			set = m.excludes
+			line = line[2:]
+		}
+		if strings.HasPrefix(line, "||") {
+			domain, rest, _ := strings.Cut(line[2:], "^")
+			if rest == "" && isBlockableHost(normalizeDomain(domain)) {
+				set.add(domain)
+			}
+			continue
+		}
+		if len(fields) == 1 && isBlockableHost(normalizeDomain(line)) {
+			m.full[normalizeDomain(line)] = struct{}{}
+		}
+	}
+}
+
+// isBlockableHost rejects the names hosts files map for the local machine
+// as well as anything that is not a plain domain name.
+func isBlockableHost(host string) bool {
+	switch host {
+	case "", "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return false
+	}
+	return strings.Contains(host, ".") && !strings.ContainsAny(host, "*/|$,=") && net.ParseIP(host) == nil
+}
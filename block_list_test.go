@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBlockList(t *testing.T) *blockList {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	require.Nil(t, os.WriteFile(hosts, []byte(`# hosts
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.com # trackers
+::1 ip6-localhost
+`), 0600))
+	filters := filepath.Join(dir, "filters.txt")
+	require.Nil(t, os.WriteFile(filters, []byte(`! AdGuard
+[Adblock Plus 2.0]
+||doubleclick.net^
+||analytics.example.org^$third-party
+@@||safe.doubleclick.net^
+##.banner
+/ads/*
+adservice.example.net
+`), 0600))
+
+	l := newBlockList([]string{hosts, filters}, nil)
+	require.Nil(t, l.update(context.Background()))
+	return l
+}
+
+func TestBlockList(t *testing.T) {
+	l := newTestBlockList(t)
+
+	require.True(t, l.blocked("ads.example.com", "proxy"))
+	require.False(t, l.blocked("cdn.ads.example.com", "proxy"))
+	require.True(t, l.blocked("Stats.DoubleClick.net.", "dns"))
+	require.True(t, l.blocked("doubleclick.net", "proxy"))
+	require.False(t, l.blocked("safe.doubleclick.net", "proxy"))
+	require.False(t, l.blocked("analytics.example.org", "proxy"))
+	require.True(t, l.blocked("adservice.example.net", "proxy"))
+	require.False(t, l.blocked("localhost", "proxy"))
+	require.False(t, l.blocked("www.example.com", "proxy"))
+
+	stats := l.stats()
+	require.Equal(t, uint64(3), stats.Proxy)
+	require.Equal(t, uint64(1), stats.DNS)
+	require.Equal(t, map[string]uint64{
+		"ads.example.com":       1,
+		"stats.doubleclick.net": 1,
+		"doubleclick.net":       1,
+		"adservice.example.net": 1,
+	}, stats.Domains)
+
+	var none *blockList
+	require.False(t, none.blocked("ads.example.com", "proxy"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// newConfigFlag returns the --config flag of a command.
+func newConfigFlag(destination *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "config",
+		Value:       "",
+		Usage:       "YAML file with options named like the flags, flags given on the command line take precedence",
+		Destination: destination,
+	}
+}
+
+// loadConfigBefore returns a cli.BeforeFunc that applies the --config file
+// to the flags of the command. Keys of extra are options that only exist in
+// the file and hold a list of strings.
+func loadConfigBefore(extra map[string]*[]string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		if path := c.String("config"); path != "" {
+			return loadConfig(c, path, extra)
+		}
+		return nil
+	}
+}
+
+// loadConfig reads a YAML mapping of flag names to values and sets every
+// flag that was not given on the command line. A string flag takes a
+// scalar, an int or bool flag a number or a boolean, and a repeatable flag
+// a list or a single scalar. ${NAME} in any value is replaced with the
+// environment variable NAME, so that secrets need not be written to the
+// file nor appear in the process list.
+func loadConfig(c *cli.Context, path string, extra map[string]*[]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config %s error: %v", path, err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("parse config %s error: %v", path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expect a mapping of option names to values", path, doc.Line)
+	}
+
+	flags := make(map[string]cli.Flag)
+	for _, f := range c.Command.Flags {
+		for _, name := range f.Names() {
+			flags[name] = f
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		name := key.Value
+		if seen[name] {
+			return fmt.Errorf("%s:%d: duplicate option %q", path, key.Line, name)
+		}
+		seen[name] = true
+
+		if err := expandConfigEnv(value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, value.Line, name, err)
+		}
+
+		if list, ok := extra[name]; ok {
+			if *list, err = configStrings(value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", path, value.Line, name, err)
+			}
+			continue
+		}
+
+		f, ok := flags[name]
+		if !ok || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %q", path, key.Line, name)
+		}
+		if c.IsSet(name) {
+			continue
+		}
+		values, err := configFlagValues(f, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, value.Line, name, err)
+		}
+		for _, v := range values {
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", path, value.Line, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFlagValues converts a YAML value into the strings to set the flag
+// to, one per element for a repeatable flag.
+func configFlagValues(f cli.Flag, value *yaml.Node) ([]string, error) {
+	if _, ok := f.(*cli.StringSliceFlag); ok {
+		return configStrings(value)
+	}
+	if value.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("expect a single value")
+	}
+
+	switch f.(type) {
+	case *cli.BoolFlag:
+		b, err := strconv.ParseBool(value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("expect true or false, got %q", value.Value)
+		}
+		return []string{strconv.FormatBool(b)}, nil
+	case *cli.IntFlag:
+		n, err := strconv.Atoi(value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("expect an integer, got %q", value.Value)
+		}
+		return []string{strconv.Itoa(n)}, nil
+	}
+	return []string{value.Value}, nil
+}
+
+// configStrings accepts a list of scalars or a single scalar.
+func configStrings(value *yaml.Node) ([]string, error) {
+	if value.Kind == yaml.ScalarNode {
+		return []string{value.Value}, nil
+	}
+	if value.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("expect a list")
+	}
+	values := make([]string, 0, len(value.Content))
+	for _, item := range value.Content {
+		if item.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: expect a list of single values", item.Line)
+		}
+		values = append(values, item.Value)
+	}
+	return values, nil
+}
+
+var configEnvPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandConfigEnv replaces ${NAME} in every scalar under node with the
+// environment variable NAME, which must be set.
+func expandConfigEnv(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var err error
+		node.Value = configEnvPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := configEnvPattern.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+			return v
+		})
+		return err
+	}
+	for _, child := range node.Content {
+		if err := expandConfigEnv(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+type testConfigFlags struct {
+	listenAddr string
+	poolSize   int
+	fallback   bool
+	remotes    cli.StringSlice
+	rules      []string
+}
+
+// runWithConfig runs a command with a few flags of every kind, a config
+// file with content and the command line args.
+func runWithConfig(t *testing.T, content string, args ...string) (*testConfigFlags, error) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+	flags := &testConfigFlags{}
+	cmd := &cli.Command{
+		Name:   "start",
+		Before: loadConfigBefore(map[string]*[]string{"rules": &flags.rules}),
+		Flags: []cli.Flag{
+			newConfigFlag(nil),
+			&cli.StringFlag{Name: "listen-addr", Value: "127.0.0.1:5686", Destination: &flags.listenAddr},
+			&cli.IntFlag{Name: "pool-size", Value: 4, Destination: &flags.poolSize},
+			&cli.BoolFlag{Name: "fallback", Value: true, Destination: &flags.fallback},
+			&cli.StringSliceFlag{Name: "remote", Value: cli.NewStringSlice("https://default.example.com"), Destination: &flags.remotes},
+		},
+		Action: func(*cli.Context) error { return nil },
+	}
+	app := &cli.App{Commands: []*cli.Command{cmd}}
+	err := app.Run(append([]string{"sandwich", "start", "--config", path}, args...))
+	return flags, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("SANDWICH_TEST_SECRET", "s3cret")
+	flags, err := runWithConfig(t, `
+listen-addr: 0.0.0.0:5686
+pool-size: 8
+fallback: false
+remote:
+  - https://${SANDWICH_TEST_SECRET}@hk.example.com#hk
+  - https://jp.example.com#jp
+rules:
+  - DOMAIN-SUFFIX,example.com,DIRECT
+`, "--pool-size", "16")
+	require.Nil(t, err)
+	require.Equal(t, "0.0.0.0:5686", flags.listenAddr)
+	require.Equal(t, 16, flags.poolSize)
+	require.False(t, flags.fallback)
+	require.Equal(t, []string{"https://s3cret@hk.example.com#hk", "https://jp.example.com#jp"}, flags.remotes.Value())
+	require.Equal(t, []string{"DOMAIN-SUFFIX,example.com,DIRECT"}, flags.rules)
+
+	flags, err = runWithConfig(t, "", "--listen-addr", ":1186")
+	require.Nil(t, err)
+	require.Equal(t, ":1186", flags.listenAddr)
+	require.Equal(t, []string{"https://default.example.com"}, flags.remotes.Value())
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for content, message := range map[string]string{
+		"listen-addr: :1186\nlisten-port: 1186\n": `config.yaml:2: unknown option "listen-port"`,
+		"pool-size: many\n":                       `config.yaml:1: pool-size: expect an integer, got "many"`,
+		"fallback: sometimes\n":                   `config.yaml:1: fallback: expect true or false, got "sometimes"`,
+		"listen-addr:\n  - :1186\n":               `config.yaml:2: listen-addr: expect a single value`,
+		"remote: https://${SANDWICH_UNSET}\n":     `config.yaml:1: remote: environment variable SANDWICH_UNSET is not set`,
+		"pool-size: 1\npool-size: 2\n":            `config.yaml:2: duplicate option "pool-size"`,
+		"- listen-addr\n":                         `config.yaml:1: expect a mapping of option names to values`,
+	} {
+		_, err := runWithConfig(t, content)
+		require.NotNil(t, err, content)
+		require.Contains(t, err.Error(), message)
+	}
+}
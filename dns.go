@@ -10,6 +10,7 @@ import (
     "net"
     "net/http"
     "net/url"
+    "strings"
     "sync"
     "time"
 
@@ -20,32 +21,60 @@ import (
 
 const (
     timeout = 10 * time.Second
+
+    // systemTTL is the TTL given to the records of the hosts file and the
+    // system resolver, which do not tell one.
+    systemTTL = time.Minute
+
+    // negativeTTL is how long a lookup that found no record is cached, so
+    // that the missing family of a host is not looked up for every
+    // connection.
+    negativeTTL = time.Minute
 )
 
-type answerCache struct {
+// dnsRecord is an A or AAAA record, expiredAt is derived from its own TTL.
+type dnsRecord struct {
     ip        net.IP
     expiredAt time.Time
 }
 
+// unexpired returns the records that are still valid.
+func unexpired(records []dnsRecord) []dnsRecord {
+    now := time.Now()
+    var valid []dnsRecord
+    for _, r := range records {
+        if !r.expiredAt.Before(now) {
+            valid = append(valid, r)
+        }
+    }
+    return valid
+}
+
 type dnsResolver struct {
-    waiters  []chan answerCache
-    answer   answerCache
+    waiters  []chan []dnsRecord
+    records  []dnsRecord
     finished bool
+
+    // expiredAt is when a lookup that found no record is tried again.
+    expiredAt time.Time
 }
 
+// dnsResovler resolves host to all its addresses of the family selected by
+// qtype, which is either dns.TypeA or dns.TypeAAAA.
 type dnsResovler interface {
-    lookup(host string) (err error, ip net.IP, expriedAt time.Time)
+    lookup(host string, qtype uint16) (err error, records []dnsRecord)
     name() string
 }
 
 type dnsOverHostsFile struct{}
 
-func (d *dnsOverHostsFile) lookup(host string) (err error, ip net.IP, expriedAt time.Time) {
-    res := goLookupIPFiles(host)
-    if len(res) == 0 {
-        return nil, nil, time.Now()
+func (d *dnsOverHostsFile) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    for _, addr := range goLookupIPFiles(host) {
+        if isIPv4(addr.IP) == (qtype == dns.TypeA) {
+            records = append(records, dnsRecord{ip: addr.IP, expiredAt: time.Now().Add(systemTTL)})
+        }
     }
-    return nil, res[0].IP, time.Now()
+    return nil, records
 }
 func (d *dnsOverHostsFile) name() string {
     return "dnsOverHostsFile"
@@ -53,16 +82,22 @@ func (d *dnsOverHostsFile) name() string {
 
 type dnsOverUDP struct{}
 
-func (d *dnsOverUDP) lookup(host string) (err error, ip net.IP, expriedAt time.Time) {
-    expriedAt = time.Now()
-
-    answers, err := net.LookupIP(host)
+func (d *dnsOverUDP) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    network := "ip4"
+    if qtype == dns.TypeAAAA {
+        network = "ip6"
+    }
+    answers, err := net.DefaultResolver.LookupIP(context.Background(), network, host)
     if err != nil {
         err = fmt.Errorf("lookup error: %v", err)
-        return err, nil, expriedAt
+        return err, nil
     }
 
-    return nil, answers[0], expriedAt
+    // the system resolver does not tell the TTL
+    for _, ip := range answers {
+        records = append(records, dnsRecord{ip: ip, expiredAt: time.Now().Add(systemTTL)})
+    }
+    return nil, records
 }
 
 func (d *dnsOverUDP) name() string {
@@ -74,21 +109,48 @@ type dnsOverHTTPS struct {
     provider  string
 }
 
-func (d *dnsOverHTTPS) lookup(host string) (err error, ip net.IP, expriedAt time.Time) {
-    expriedAt = time.Now()
-
+func (d *dnsOverHTTPS) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
     msg := new(dns.Msg)
-    msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+    msg.SetQuestion(dns.Fqdn(host), qtype)
     msg.RecursionDesired = true
 
+    response, err := d.exchange(msg)
+    if err != nil {
+        return err, nil
+    }
+
+    for _, answer := range response.Answer {
+        var ip net.IP
+        switch rr := answer.(type) {
+        case *dns.A:
+            ip = rr.A
+        case *dns.AAAA:
+            ip = rr.AAAA
+        default:
+            continue
+        }
+        records = append(records, dnsRecord{
+            ip:        ip,
+            expiredAt: time.Now().Add(time.Duration(answer.Header().Ttl) * time.Second),
+        })
+    }
+    if len(records) == 0 {
+        return fmt.Errorf("no answer found"), nil
+    }
+    return nil, records
+}
+
+// exchange sends msg to the provider as described in RFC 8484 and returns
+// the response message.
+func (d *dnsOverHTTPS) exchange(msg *dns.Msg) (*dns.Msg, error) {
     buf, err := msg.Pack()
     if err != nil {
-        return fmt.Errorf("pack dns message error: %v", err), nil, expriedAt
+        return nil, fmt.Errorf("pack dns message error: %v", err)
     }
 
     queryURL, err := url.Parse(d.provider)
     if err != nil {
-        return fmt.Errorf("parse provider error: %v", err), nil, expriedAt
+        return nil, fmt.Errorf("parse provider error: %v", err)
     }
 
     dnsParam := base64.RawURLEncoding.EncodeToString(buf)
@@ -98,7 +160,7 @@ func (d *dnsOverHTTPS) lookup(host string) (err error, ip net.IP, expriedAt time
 
     req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, queryURL.String(), nil)
     if err != nil {
-        return fmt.Errorf("create request error: %v", err), nil, expriedAt
+        return nil, fmt.Errorf("create request error: %v", err)
     }
 
     req.Header.Set("Accept", "application/dns-message")
@@ -111,39 +173,75 @@ func (d *dnsOverHTTPS) lookup(host string) (err error, ip net.IP, expriedAt time
     }
     resp, err := client.Do(req)
     if err != nil {
-        return fmt.Errorf("do request error: %v", err), nil, expriedAt
+        return nil, fmt.Errorf("do request error: %v", err)
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("unexpected status code: %d", resp.StatusCode), nil, expriedAt
+        return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
     }
 
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return fmt.Errorf("read response error: %v", err), nil, expriedAt
+        return nil, fmt.Errorf("read response error: %v", err)
     }
 
     response := new(dns.Msg)
     if err := response.Unpack(body); err != nil {
-        return fmt.Errorf("unpack response error: %v", err), nil, expriedAt
-    }
-
-    for _, answer := range response.Answer {
-        if a, ok := answer.(*dns.A); ok {
-            ip = a.A
-            expriedAt = time.Now().Add(time.Duration(a.Header().Ttl) * time.Second)
-            return nil, ip, expriedAt
-        }
+        return nil, fmt.Errorf("unpack response error: %v", err)
     }
-
-    return fmt.Errorf("no answer found"), nil, expriedAt
+    return response, nil
 }
 
 func (d *dnsOverHTTPS) name() string {
     return "dnsOverHTTPS"
 }
 
+const (
+    dnsBackendHosts  = "hosts"
+    dnsBackendDoH    = "doh"
+    dnsBackendSystem = "system"
+)
+
+// parseDNSBackends builds the resolver chain from the names of its backends
+// in the order they are asked: hosts for the hosts file, system for the
+// system resolver, and doh for DNS over HTTPS through provider, or doh:<url>
+// through another one. It also returns the first DNS over HTTPS backend, nil
+// if there is none.
+func parseDNSBackends(names []string, provider string, staticTTL time.Duration) ([]dnsResovler, *dnsOverHTTPS, error) {
+    if len(names) == 0 {
+        return nil, nil, fmt.Errorf("at least one DNS backend is required")
+    }
+
+    var backends []dnsResovler
+    var firstDoH *dnsOverHTTPS
+    for _, name := range names {
+        name = strings.TrimSpace(name)
+        kind, location, _ := strings.Cut(name, ":")
+        switch {
+        case name == dnsBackendHosts:
+            backends = append(backends, &dnsOverHostsFile{})
+        case name == dnsBackendSystem:
+            backends = append(backends, &dnsOverUDP{})
+        case kind == dnsBackendDoH:
+            if location == "" {
+                location = provider
+            }
+            if u, err := url.Parse(location); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+                return nil, nil, fmt.Errorf("invalid DNS over HTTPS provider %q", location)
+            }
+            doh := &dnsOverHTTPS{provider: location, staticTTL: staticTTL}
+            if firstDoH == nil {
+                firstDoH = doh
+            }
+            backends = append(backends, doh)
+        default:
+            return nil, nil, fmt.Errorf("unknown DNS backend %q, expect %s, %s, %s or %s:<url>", name, dnsBackendHosts, dnsBackendDoH, dnsBackendSystem, dnsBackendDoH)
+        }
+    }
+    return backends, firstDoH, nil
+}
+
 type cachedDNS struct {
     sync.RWMutex
     backends []dnsResovler
@@ -158,43 +256,56 @@ func newCachedDNS(backends ...dnsResovler) *cachedDNS {
     return d
 }
 
-func (d *cachedDNS) lookup(host string) (err error, ip net.IP, expriedAt time.Time) {
+// cacheKey keeps the answers of the two address families apart.
+type cacheKey struct {
+    host  string
+    qtype uint16
+}
+
+// lookup returns the cached records that have not expired yet, and resolves
+// host again once all of them have. A lookup that found no record is cached
+// for negativeTTL.
+func (d *cachedDNS) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
     d.Lock()
 
-    cached, ok := d.cache.Get(host)
+    key := cacheKey{host: host, qtype: qtype}
+    cached, ok := d.cache.Get(key)
     var resolver *dnsResolver
     if !ok {
         resolver = &dnsResolver{}
-        d.cache.Add(host, resolver)
+        d.cache.Add(key, resolver)
     } else {
         resolver = cached.(*dnsResolver)
-        if resolver.finished && resolver.answer.expiredAt.Before(time.Now()) {
-            resolver.finished = false
-            ok = false
+        if resolver.finished {
+            records = unexpired(resolver.records)
+            if len(records) == 0 && !time.Now().Before(resolver.expiredAt) {
+                resolver.finished = false
+                ok = false
+            }
         }
     }
 
     if resolver.finished {
         d.Unlock()
-        return nil, resolver.answer.ip, resolver.answer.expiredAt
+        return nil, records
     }
 
-    ch := make(chan answerCache, 1)
+    ch := make(chan []dnsRecord, 1)
     resolver.waiters = append(resolver.waiters, ch)
     d.Unlock()
 
     if !ok {
-        go d.do(host)
+        go d.do(key, resolver)
     }
 
     timeout := time.NewTimer(timeout)
     defer timeout.Stop()
 
     select {
-    case answer := <-ch:
-        return nil, answer.ip, answer.expiredAt
+    case records := <-ch:
+        return nil, records
     case <-timeout.C:
-        return fmt.Errorf("timeout"), nil, time.Now()
+        return fmt.Errorf("timeout"), nil
     }
 }
 
@@ -202,17 +313,18 @@ func (d *cachedDNS) name() string {
     return "cachedDNS"
 }
 
-func (d *cachedDNS) do(host string) {
-    var ip net.IP
-    var expriedAt = time.Now()
+// do resolves key and answers the waiters of resolver, which may have been
+// evicted from the cache in the meantime.
+func (d *cachedDNS) do(key cacheKey, resolver *dnsResolver) {
+    var records []dnsRecord
     var err error
 
     for _, backend := range d.backends {
-        if err, ip, expriedAt = backend.lookup(host); err != nil {
-            log.Printf("backend(%s) lookup %s error: %v", backend.name(), host, err)
+        if err, records = backend.lookup(key.host, key.qtype); err != nil {
+            log.Printf("backend(%s) lookup %s %s error: %v", backend.name(), key.host, dns.TypeToString[key.qtype], err)
             continue
         }
-        if ip == nil {
+        if len(records) == 0 {
             continue
         }
         break
@@ -221,14 +333,15 @@ func (d *cachedDNS) do(host string) {
     d.Lock()
     defer d.Unlock()
 
-    cache, _ := d.cache.Get(host)
-    resolver := cache.(*dnsResolver)
     resolver.finished = true
-    resolver.answer.ip = ip
-    resolver.answer.expiredAt = expriedAt
+    resolver.records = records
+    resolver.expiredAt = time.Time{}
+    if len(records) == 0 {
+        resolver.expiredAt = time.Now().Add(negativeTTL)
+    }
 
     for _, ch := range resolver.waiters {
-        ch <- resolver.answer
+        ch <- resolver.records
         close(ch)
     }
     resolver.waiters = nil
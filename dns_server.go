@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsExchanger forwards a complete DNS query and returns the response.
+type dnsExchanger interface {
+	exchange(msg *dns.Msg) (*dns.Msg, error)
+}
+
+// dnsServer lets the local box act as the DNS server of a LAN so that
+// devices which cannot use a proxy are still protected from DNS poisoning.
+// A and AAAA queries are answered from the local proxy's resolver chain and
+// cache, every other query is forwarded upstream. Names in the block list
+// get NXDOMAIN. With fakeIPs, domains are answered with fake addresses that
+// the proxy maps back to the domain, so no real lookup is made at all.
+type dnsServer struct {
+	resolver   dnsResovler
+	upstream   dnsExchanger
+	accessList *accessList
+	blockList  *blockList
+	fakeIPs    *fakeIPPool
+}
+
+// newDNSServer returns a DNS server answering with the resolvers and lists
+// of the local proxy.
+func newDNSServer(proxy *localProxyServer) *dnsServer {
+	return &dnsServer{
+		resolver:   proxy.dns,
+		upstream:   proxy.dnsUpstream,
+		accessList: proxy.accessList,
+		blockList:  proxy.blockList,
+		fakeIPs:    proxy.fakeIPs,
+	}
+}
+
+// listenAndServeDNS serves DNS over both UDP and TCP on addr and returns
+// once either of them stops.
+func listenAndServeDNS(addr string, handler dns.Handler) error {
+	errs := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: addr, Net: network, Handler: handler}
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	return <-errs
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if !s.accessList.allowedAddr(w.RemoteAddr().String()) {
+		log.Printf("deny dns client %s", w.RemoteAddr())
+		s.reply(w, req, new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+		return
+	}
+
+	if len(req.Question) != 1 {
+		s.reply(w, req, new(dns.Msg).SetRcode(req, dns.RcodeFormatError))
+		return
+	}
+
+	q := req.Question[0]
+	if s.blockList.blocked(q.Name, "dns") {
+		s.reply(w, req, new(dns.Msg).SetRcode(req, dns.RcodeNameError))
+		return
+	}
+	if (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && q.Qclass == dns.ClassINET {
+		if s.fakeIPs != nil && strings.Contains(strings.TrimSuffix(q.Name, "."), ".") {
+			s.reply(w, req, s.answerFake(req))
+			return
+		}
+		if res := s.answer(req); res != nil {
+			s.reply(w, req, res)
+			return
+		}
+	}
+
+	s.reply(w, req, s.forward(req))
+}
+
+// answer answers an A or AAAA query with every address the resolver has,
+// each with the TTL left on its own record. It returns nil when the
+// resolver has no address of the family so that the query gets forwarded
+// instead.
+func (s *dnsServer) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	err, records := s.resolver.lookup(strings.TrimSuffix(dns.CanonicalName(q.Name), "."), q.Qtype)
+	if err != nil {
+		log.Printf("dns server resolve %s error: %v", q.Name, err)
+		return nil
+	}
+
+	res := new(dns.Msg).SetReply(req)
+	res.RecursionAvailable = true
+	for _, record := range records {
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    ttlUntil(record.expiredAt),
+		}
+		switch {
+		case q.Qtype == dns.TypeA && isIPv4(record.ip):
+			res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: record.ip.To4()})
+		case q.Qtype == dns.TypeAAAA && !isIPv4(record.ip):
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: record.ip.To16()})
+		}
+	}
+	if len(res.Answer) == 0 {
+		return nil
+	}
+	return res
+}
+
+// answerFake answers an A query with the fake address of the name. AAAA
+// queries get an empty answer so that clients fall back to IPv4.
+func (s *dnsServer) answerFake(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	res := new(dns.Msg).SetReply(req)
+	res.RecursionAvailable = true
+	if q.Qtype == dns.TypeA {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: fakeIPTTL}
+		ip := s.fakeIPs.lookupIP(strings.TrimSuffix(dns.CanonicalName(q.Name), "."))
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ip})
+	}
+	return res
+}
+
+func (s *dnsServer) forward(req *dns.Msg) *dns.Msg {
+	res, err := s.upstream.exchange(req.Copy())
+	if err != nil {
+		log.Printf("dns server forward %s error: %v", req.Question[0].Name, err)
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+	res.Id = req.Id
+	return res
+}
+
+func (s *dnsServer) reply(w dns.ResponseWriter, req, res *dns.Msg) {
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		res.Truncate(size)
+	}
+	if err := w.WriteMsg(res); err != nil {
+		log.Printf("dns server reply to %s error: %v", w.RemoteAddr(), err)
+	}
+}
+
+// ttlUntil converts an absolute expiry into a TTL in seconds.
+func ttlUntil(expiredAt time.Time) uint32 {
+	ttl := time.Until(expiredAt)
+	if ttl <= 0 {
+		return 0
+	}
+	return uint32(ttl.Round(time.Second) / time.Second)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// staticResolver answers with every address of the asked family, valid for
+// one minute.
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+	for _, ip := range r[host] {
+		if isIPv4(ip) == (qtype == dns.TypeA) {
+			records = append(records, dnsRecord{ip: ip, expiredAt: time.Now().Add(time.Minute)})
+		}
+	}
+	return nil, records
+}
+
+func (r staticResolver) name() string {
+	return "staticResolver"
+}
+
+type staticExchanger struct {
+	mx string
+}
+
+func (e *staticExchanger) exchange(msg *dns.Msg) (*dns.Msg, error) {
+	res := new(dns.Msg).SetReply(msg)
+	res.Id = 0
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 300 IN MX 10 " + e.mx)
+	res.Answer = append(res.Answer, rr)
+	return res, nil
+}
+
+func newTestDNSServer(t *testing.T, s *dnsServer) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := &dns.Server{PacketConn: pc, Handler: s}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestDNSServerAnswersFromResolver(t *testing.T) {
+	addr := newTestDNSServer(t, &dnsServer{
+		resolver: staticResolver{"www.example.com": parseIPs("1.2.3.4", "2001:db8::1", "5.6.7.8")},
+		upstream: &staticExchanger{mx: "mail.example.com."},
+	})
+
+	msg := new(dns.Msg).SetQuestion("WWW.example.com.", dns.TypeA)
+	res, _, err := new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Len(t, res.Answer, 2)
+	a := res.Answer[0].(*dns.A)
+	require.Equal(t, "1.2.3.4", a.A.String())
+	require.Equal(t, "WWW.example.com.", a.Hdr.Name)
+	require.InDelta(t, 60, a.Hdr.Ttl, 1)
+	require.Equal(t, "5.6.7.8", res.Answer[1].(*dns.A).A.String())
+
+	msg = new(dns.Msg).SetQuestion("www.example.com.", dns.TypeAAAA)
+	res, _, err = new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Len(t, res.Answer, 1)
+	require.Equal(t, "2001:db8::1", res.Answer[0].(*dns.AAAA).AAAA.String())
+
+	msg = new(dns.Msg).SetQuestion("example.com.", dns.TypeMX)
+	res, _, err = new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Equal(t, msg.Id, res.Id)
+	require.Len(t, res.Answer, 1)
+	require.Equal(t, "mail.example.com.", res.Answer[0].(*dns.MX).Mx)
+}
+
+func TestDNSServerRefusesDeniedClient(t *testing.T) {
+	l, _ := newAccessList(nil, []string{"127.0.0.0/8"})
+	addr := newTestDNSServer(t, &dnsServer{
+		resolver:   staticResolver{},
+		upstream:   &staticExchanger{},
+		accessList: l,
+	})
+
+	msg := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	res, _, err := new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Equal(t, dns.RcodeRefused, res.Rcode)
+}
+
+func TestDNSServerBlocksDomains(t *testing.T) {
+	addr := newTestDNSServer(t, &dnsServer{
+		resolver:  staticResolver{"ads.example.com": parseIPs("1.2.3.4")},
+		upstream:  &staticExchanger{},
+		blockList: newTestBlockList(t),
+	})
+
+	msg := new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA)
+	res, _, err := new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Empty(t, res.Answer)
+}
+
+func TestDNSServerAnswersFakeIPs(t *testing.T) {
+	pool, err := newFakeIPPool("198.18.0.0/15", "")
+	require.Nil(t, err)
+	addr := newTestDNSServer(t, &dnsServer{
+		resolver: staticResolver{"www.example.com": parseIPs("1.2.3.4")},
+		upstream: &staticExchanger{mx: "mail.example.com."},
+		fakeIPs:  pool,
+	})
+
+	msg := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	res, _, err := new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Len(t, res.Answer, 1)
+	a := res.Answer[0].(*dns.A)
+	require.Equal(t, "198.18.0.1", a.A.String())
+	require.Equal(t, uint32(fakeIPTTL), a.Hdr.Ttl)
+	domain, ok := pool.lookupHost(a.A)
+	require.True(t, ok)
+	require.Equal(t, "www.example.com", domain)
+
+	msg = new(dns.Msg).SetQuestion("www.example.com.", dns.TypeAAAA)
+	res, _, err = new(dns.Client).Exchange(msg, addr)
+	require.Nil(t, err)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Empty(t, res.Answer)
+}
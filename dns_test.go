@@ -2,7 +2,13 @@ package main
 
 import (
     "log"
+    "net"
     "testing"
+    "time"
+
+    "github.com/golang/groupcache/lru"
+    "github.com/miekg/dns"
+    "github.com/stretchr/testify/require"
 )
 
 var (
@@ -13,40 +19,185 @@ func TestLookupStaticHost(t *testing.T) {
     log.Println(goLookupIPFiles("youtube.com"))
     log.Println(goLookupIPFiles("localhost"))
     log.Println(goLookupIPFiles("host.docker.internal"))
-    log.Println((&dnsOverHostsFile{}).lookup("host.docker.internal"))
+    log.Println((&dnsOverHostsFile{}).lookup("host.docker.internal", dns.TypeA))
 }
 
 func TestCachedDNSLookUP(t *testing.T) {
-    dns := newCachedDNS(&dnsOverHostsFile{}, &dnsOverHTTPS{provider: defaultTestDoHProvider}, &dnsOverUDP{})
-    log.Println(dns.lookup("youtube.com"))
-    log.Println(dns.lookup("localhost"))
-    log.Println(dns.lookup("www.google.com"))
-    log.Println(dns.lookup("www.baidu.com"))
+    resolver := newCachedDNS(&dnsOverHostsFile{}, &dnsOverHTTPS{provider: defaultTestDoHProvider}, &dnsOverUDP{})
+    log.Println(resolver.lookup("youtube.com", dns.TypeA))
+    log.Println(resolver.lookup("localhost", dns.TypeA))
+    log.Println(resolver.lookup("www.google.com", dns.TypeA))
+    log.Println(resolver.lookup("www.baidu.com", dns.TypeA))
 }
 
 func TestDNSOverHTTPSLookUP(t *testing.T) {
-    dns := &dnsOverHTTPS{provider: defaultTestDoHProvider}
-    log.Println(dns.lookup("www.baidu.com"))
+    resolver := &dnsOverHTTPS{provider: defaultTestDoHProvider}
+    log.Println(resolver.lookup("www.baidu.com", dns.TypeA))
 }
 
 func BenchmarkCachedDNSLookUP(b *testing.B) {
-    var dns dnsResovler
-    dns = newCachedDNS(
+    var resolver dnsResovler
+    resolver = newCachedDNS(
         &dnsOverHostsFile{},
         &dnsOverHTTPS{provider: defaultTestDoHProvider},
         &dnsOverUDP{},
     )
 
     for i := 0; i < b.N; i++ {
-        dns.lookup("www.baidu.com")
+        resolver.lookup("www.baidu.com", dns.TypeA)
     }
 }
 
 func BenchmarkUDPDNSLookUP(b *testing.B) {
-    var dns dnsResovler
-    dns = &dnsOverUDP{}
+    var resolver dnsResovler
+    resolver = &dnsOverUDP{}
 
     for i := 0; i < b.N; i++ {
-        dns.lookup("www.baidu.com")
+        resolver.lookup("www.baidu.com", dns.TypeA)
+    }
+}
+
+// shortLivedResolver answers with one record that expires immediately and
+// one that lives for a minute, and counts how often it is asked.
+type shortLivedResolver struct {
+    lookups int
+}
+
+func (r *shortLivedResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    r.lookups++
+    return nil, []dnsRecord{
+        {ip: net.ParseIP("1.1.1.1"), expiredAt: time.Now().Add(-time.Second)},
+        {ip: net.ParseIP("2.2.2.2"), expiredAt: time.Now().Add(time.Minute)},
+    }
+}
+
+func (r *shortLivedResolver) name() string {
+    return "shortLivedResolver"
+}
+
+func TestCachedDNSPerRecordTTL(t *testing.T) {
+    backend := &shortLivedResolver{}
+    resolver := newCachedDNS(backend)
+
+    err, records := resolver.lookup("www.example.com", dns.TypeA)
+    require.Nil(t, err)
+    require.Len(t, records, 2)
+
+    err, records = resolver.lookup("www.example.com", dns.TypeA)
+    require.Nil(t, err)
+    require.Len(t, records, 1)
+    require.Equal(t, "2.2.2.2", records[0].ip.String())
+    require.Equal(t, 1, backend.lookups)
+
+    // the families are cached apart
+    resolver.lookup("www.example.com", dns.TypeAAAA)
+    require.Equal(t, 2, backend.lookups)
+}
+
+// ipv4OnlyResolver has A records only, and counts how often each family is
+// asked.
+type ipv4OnlyResolver struct {
+    lookups map[uint16]int
+}
+
+func (r *ipv4OnlyResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    r.lookups[qtype]++
+    if qtype == dns.TypeA {
+        records = append(records, dnsRecord{ip: net.ParseIP("1.1.1.1"), expiredAt: time.Now().Add(time.Minute)})
+    }
+    return nil, records
+}
+
+func (r *ipv4OnlyResolver) name() string {
+    return "ipv4OnlyResolver"
+}
+
+func TestCachedDNSCachesEmptyAnswers(t *testing.T) {
+    backend := &ipv4OnlyResolver{lookups: map[uint16]int{}}
+    resolver := newCachedDNS(backend)
+
+    for i := 0; i < 3; i++ {
+        err, records := resolver.lookup("www.example.com", dns.TypeAAAA)
+        require.Nil(t, err)
+        require.Len(t, records, 0)
+    }
+    require.Equal(t, 1, backend.lookups[dns.TypeAAAA])
+}
+
+// blockingResolver answers once release is closed.
+type blockingResolver struct {
+    release chan struct{}
+}
+
+func (r *blockingResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    <-r.release
+    return nil, []dnsRecord{{ip: net.ParseIP("1.1.1.1"), expiredAt: time.Now().Add(time.Minute)}}
+}
+
+func (r *blockingResolver) name() string {
+    return "blockingResolver"
+}
+
+func TestCachedDNSAnswersLookupsEvictedMidway(t *testing.T) {
+    backend := &blockingResolver{release: make(chan struct{})}
+    resolver := newCachedDNS(backend)
+    resolver.cache = lru.New(1)
+
+    cached := func(host string) func() bool {
+        return func() bool {
+            resolver.Lock()
+            defer resolver.Unlock()
+            _, ok := resolver.cache.Get(cacheKey{host: host, qtype: dns.TypeA})
+            return ok
+        }
+    }
+    answered := make(chan []dnsRecord, 2)
+    for _, host := range []string{"a.example.com", "b.example.com"} {
+        go func(host string) {
+            _, records := resolver.lookup(host, dns.TypeA)
+            answered <- records
+        }(host)
+        require.Eventually(t, cached(host), time.Second, 10*time.Millisecond)
+    }
+    // the lookup of b.example.com evicted the one of a.example.com
+    require.False(t, cached("a.example.com")())
+    close(backend.release)
+
+    for i := 0; i < 2; i++ {
+        select {
+        case records := <-answered:
+            require.Len(t, records, 1)
+        case <-time.After(time.Second):
+            t.Fatal("lookup not answered")
+        }
+    }
+}
+
+func TestParseDNSBackends(t *testing.T) {
+    backends, doh, err := parseDNSBackends([]string{"doh:https://dns.google/dns-query", "hosts", "doh", "system"}, defaultTestDoHProvider, time.Hour)
+    require.Nil(t, err)
+    var names []string
+    for _, backend := range backends {
+        names = append(names, backend.name())
+    }
+    require.Equal(t, []string{"dnsOverHTTPS", "dnsOverHostsFile", "dnsOverHTTPS", "dnsOverUDP"}, names)
+    require.Equal(t, "https://dns.google/dns-query", doh.provider)
+    require.Equal(t, defaultTestDoHProvider, backends[2].(*dnsOverHTTPS).provider)
+
+    backends, doh, err = parseDNSBackends([]string{"hosts", "system"}, defaultTestDoHProvider, time.Hour)
+    require.Nil(t, err)
+    require.Len(t, backends, 2)
+    require.Nil(t, doh)
+
+    for _, names := range [][]string{
+        nil,
+        {"udp"},
+        {"doh:"},
+        {"doh:dns.google"},
+        {"doh:ftp://dns.google"},
+        {"hosts:/etc/hosts"},
+    } {
+        _, _, err := parseDNSBackends(names, "", time.Hour)
+        require.NotNil(t, err, names)
     }
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// domainSet matches host names against a set of domains. A domain matches
+// itself and all of its subdomains.
+type domainSet map[string]struct{}
+
+// loadDomainSet reads one domain per line. Empty lines and lines starting
+// with '#' are ignored, as are leading "*." or "." wildcards.
+func loadDomainSet(path string) (domainSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := make(domainSet)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set.add(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (s domainSet) add(domain string) {
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain != "" {
+		s[domain] = struct{}{}
+	}
+}
+
+func (s domainSet) contains(host string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for {
+		if _, ok := s[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainSetContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	require.Nil(t, os.WriteFile(path, []byte("# comment\ngoogle.com\n*.youtube.com\n\n.cn\n"), 0600))
+
+	set, err := loadDomainSet(path)
+	require.Nil(t, err)
+
+	require.True(t, set.contains("google.com"))
+	require.True(t, set.contains("www.Google.com."))
+	require.True(t, set.contains("m.youtube.com"))
+	require.True(t, set.contains("www.gov.cn"))
+	require.False(t, set.contains("notgoogle.com"))
+	require.False(t, set.contains("com"))
+
+	var empty domainSet
+	require.False(t, empty.contains("google.com"))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fakeIPTTL is the TTL of fake answers. It is kept short so that clients
+// ask again rather than keep using an address that has been given to
+// another domain in the meantime.
+const fakeIPTTL = 1
+
+// fakeIPPool hands out addresses from a reserved IPv4 range, one per
+// domain, and maps them back to the domain when a connection to such an
+// address reaches the proxy. When the range is used up the least recently
+// used domain gives its address away. With a path the mapping is saved to
+// and loaded from a file, so that clients keep working across restarts.
+type fakeIPPool struct {
+	network *net.IPNet
+	first   uint32
+	last    uint32
+	path    string
+
+	sync.Mutex
+	next     uint32
+	lru      *list.List
+	byDomain map[string]*list.Element
+	byIP     map[uint32]*list.Element
+	dirty    bool
+}
+
+type fakeIPEntry struct {
+	ip     uint32
+	domain string
+}
+
+// newFakeIPPool creates a pool over an IPv4 CIDR such as 198.18.0.0/15. The
+// network and broadcast addresses are never handed out.
+func newFakeIPPool(cidr, path string) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if network.IP.To4() == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake IP range %s must be an IPv4 network of at least 4 addresses", cidr)
+	}
+	first := binary.BigEndian.Uint32(network.IP.To4()) + 1
+	last := first + uint32(1)<<(32-ones) - 3
+	return &fakeIPPool{
+		network:  network,
+		first:    first,
+		last:     last,
+		path:     path,
+		next:     first,
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+// contains reports whether ip is in the fake range. A nil pool contains
+// nothing.
+func (p *fakeIPPool) contains(ip net.IP) bool {
+	return p != nil && ip != nil && p.network.Contains(ip)
+}
+
+// lookupIP returns the fake address of domain, handing out a new one if the
+// domain has none yet.
+func (p *fakeIPPool) lookupIP(domain string) net.IP {
+	domain = normalizeDomain(domain)
+	p.Lock()
+	defer p.Unlock()
+
+	if e, ok := p.byDomain[domain]; ok {
+		p.lru.MoveToFront(e)
+		return uint32ToIP(e.Value.(*fakeIPEntry).ip)
+	}
+
+	var ip uint32
+	if p.next <= p.last {
+		ip = p.next
+		p.next++
+	} else {
+		oldest := p.lru.Back()
+		entry := oldest.Value.(*fakeIPEntry)
+		p.remove(oldest)
+		ip = entry.ip
+	}
+	p.add(ip, domain)
+	return uint32ToIP(ip)
+}
+
+// lookupHost returns the domain that ip was handed out for.
+func (p *fakeIPPool) lookupHost(ip net.IP) (string, bool) {
+	if !p.contains(ip) {
+		return "", false
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	e, ok := p.byIP[binary.BigEndian.Uint32(ip.To4())]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).domain, true
+}
+
+func (p *fakeIPPool) add(ip uint32, domain string) {
+	e := p.lru.PushFront(&fakeIPEntry{ip: ip, domain: domain})
+	p.byDomain[domain] = e
+	p.byIP[ip] = e
+	p.dirty = true
+}
+
+func (p *fakeIPPool) remove(e *list.Element) {
+	entry := p.lru.Remove(e).(*fakeIPEntry)
+	delete(p.byDomain, entry.domain)
+	delete(p.byIP, entry.ip)
+	p.dirty = true
+}
+
+// load reads the mapping saved by save. A missing file is not an error.
+// Entries outside the current range are dropped.
+func (p *fakeIPPool) load() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			continue
+		}
+		n := binary.BigEndian.Uint32(ip)
+		if n < p.first || n > p.last {
+			continue
+		}
+		domain := normalizeDomain(fields[1])
+		if e, ok := p.byIP[n]; ok {
+			p.remove(e)
+		}
+		if e, ok := p.byDomain[domain]; ok {
+			p.remove(e)
+		}
+		p.add(n, domain)
+		if n >= p.next {
+			p.next = n + 1
+		}
+	}
+	p.dirty = false
+	return scanner.Err()
+}
+
+// save writes the mapping, least recently used first, if it changed since
+// the last load or save.
+func (p *fakeIPPool) save() error {
+	if p == nil || p.path == "" {
+		return nil
+	}
+	p.Lock()
+	if !p.dirty {
+		p.Unlock()
+		return nil
+	}
+	var b bytes.Buffer
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeIPEntry)
+		fmt.Fprintf(&b, "%s %s\n", uint32ToIP(entry.ip), entry.domain)
+	}
+	p.dirty = false
+	p.Unlock()
+
+	tmp := p.path + ".tmp"
+	err := os.WriteFile(tmp, b.Bytes(), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, p.path)
+	}
+	if err != nil {
+		p.Lock()
+		p.dirty = true
+		p.Unlock()
+	}
+	return err
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
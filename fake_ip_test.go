@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	pool, err := newFakeIPPool("198.18.0.0/30", "")
+	require.Nil(t, err)
+
+	a := pool.lookupIP("a.example.com")
+	require.Equal(t, "198.18.0.1", a.String())
+	require.Equal(t, a, pool.lookupIP("A.example.com."))
+	b := pool.lookupIP("b.example.com")
+	require.Equal(t, "198.18.0.2", b.String())
+
+	domain, ok := pool.lookupHost(a)
+	require.True(t, ok)
+	require.Equal(t, "a.example.com", domain)
+
+	// the pool is full, b.example.com is the least recently used
+	c := pool.lookupIP("c.example.com")
+	require.Equal(t, b, c)
+	domain, ok = pool.lookupHost(b)
+	require.True(t, ok)
+	require.Equal(t, "c.example.com", domain)
+
+	_, ok = pool.lookupHost(net.ParseIP("198.18.0.3"))
+	require.False(t, ok)
+	require.False(t, pool.contains(net.ParseIP("1.2.3.4")))
+
+	_, err = newFakeIPPool("2001:db8::/64", "")
+	require.NotNil(t, err)
+	_, err = newFakeIPPool("198.18.0.0/31", "")
+	require.NotNil(t, err)
+}
+
+func TestFakeIPPoolPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake-ip")
+	pool, err := newFakeIPPool("198.18.0.0/15", path)
+	require.Nil(t, err)
+	a := pool.lookupIP("a.example.com")
+	b := pool.lookupIP("b.example.com")
+	require.Nil(t, pool.save())
+
+	pool, err = newFakeIPPool("198.18.0.0/15", path)
+	require.Nil(t, err)
+	require.Nil(t, pool.load())
+	domain, ok := pool.lookupHost(a)
+	require.True(t, ok)
+	require.Equal(t, "a.example.com", domain)
+	require.Equal(t, b, pool.lookupIP("b.example.com"))
+	require.Equal(t, "198.18.0.3", pool.lookupIP("c.example.com").String())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// srcAddrKey is the context key of the client address of a forwarded
+// request, so that the dial of its upstream connection can route by it.
+type srcAddrKey struct{}
+
+// newForwardProxy returns a proxy for absolute-form HTTP requests that are
+// not CONNECT. Each request is forwarded on its own through transport,
+// hop-by-hop headers are dropped in both directions, and Upgrade requests
+// such as WebSocket, Expect: 100-continue and HTTP/1.0 clients are handled
+// by httputil.ReverseProxy.
+func newForwardProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		// the request URL is already absolute and Host is kept as is; no
+		// X-Forwarded-* headers are added so that the client is not exposed
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: transport,
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("forward %s %s error: %v", req.Method, req.URL, err)
+			if errors.Is(err, errRejected) || errors.Is(err, errBlocked) {
+				http.Error(rw, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		},
+	}
+}
+
+// newForwardTransport returns a transport that opens connections with dial
+// and reuses them per target. The idle timeout of timeouts closes upstream
+// connections that stall, even in the middle of a response, and bounds the
+// wait for response headers; the TLS handshake timeout bounds the handshake
+// with https targets.
+func newForwardTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error), timeouts connTimeouts) *http.Transport {
+	idleConnTimeout := 90 * time.Second
+	if timeouts.idle > 0 && timeouts.idle < idleConnTimeout {
+		idleConnTimeout = timeouts.idle
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return timeouts.closeIdle(conn), nil
+		},
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   timeouts.tlsHandshake,
+		ResponseHeaderTimeout: timeouts.idle,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// clientTransports gives every client IP its own transport. http.Transport
+// pools idle connections by target only, while the local proxy routes a
+// connection when it is dialed, e.g. by a SRC-IP rule, so a connection
+// dialed for one client must never serve the requests of another.
+type clientTransports struct {
+	newTransport func() *http.Transport
+
+	mu         sync.Mutex
+	transports *lru.Cache
+}
+
+func newClientTransports(size int, newTransport func() *http.Transport) *clientTransports {
+	transports := lru.New(size)
+	transports.OnEvicted = func(_ lru.Key, v interface{}) {
+		v.(*http.Transport).CloseIdleConnections()
+	}
+	return &clientTransports{newTransport: newTransport, transports: transports}
+}
+
+func (c *clientTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.get(addrIP(requestSrcAddr(req.Context())).String()).RoundTrip(req)
+}
+
+func (c *clientTransports) get(client string) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.transports.Get(client); ok {
+		return v.(*http.Transport)
+	}
+	transport := c.newTransport()
+	c.transports.Add(client, transport)
+	return transport
+}
+
+// CloseIdleConnections drops every transport along with its idle
+// connections.
+func (c *clientTransports) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transports.Clear()
+}
+
+// requestSrcAddr returns the client address stored by withSrcAddr.
+func requestSrcAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(srcAddrKey{}).(string)
+	return addr
+}
+
+func withSrcAddr(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), srcAddrKey{}, req.RemoteAddr))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedServer answers with its name and the hop-by-hop headers it got,
+// and echoes everything after switching to the "echo" protocol on Upgrade.
+func newNamedServer(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") == "echo" {
+			conn, buf, _ := rw.(http.Hijacker).Hijack()
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			buf.Flush()
+			io.Copy(conn, buf)
+			return
+		}
+		fmt.Fprintf(rw, "%s hop=%q proxy-connection=%q", name, req.Header.Get("X-Hop"), req.Header.Get("Proxy-Connection"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func readProxiedResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	res, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func requireForwardsEachRequest(t *testing.T, proxyAddr, extraHeaders string) {
+	a := newNamedServer(t, "a")
+	b := newNamedServer(t, "b")
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// two requests to different hosts on one keep-alive client connection
+	for _, server := range []*httptest.Server{a, b} {
+		host := strings.TrimPrefix(server.URL, "http://")
+		fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, X-Hop\r\nX-Hop: 1\r\nProxy-Connection: keep-alive\r\n%s\r\n", server.URL, host, extraHeaders)
+	}
+	res, body := readProxiedResponse(t, reader)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, `a hop="" proxy-connection=""`, body)
+	_, body = readProxiedResponse(t, reader)
+	require.Equal(t, `b hop="" proxy-connection=""`, body)
+
+	// HTTP/1.0 clients get a response they can read to the end
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.0\r\n%s\r\n", a.URL, extraHeaders)
+	res, body = readProxiedResponse(t, reader)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.HasPrefix(body, "a "))
+
+	conn, err = net.Dial("tcp", proxyAddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n%s\r\n", a.URL, strings.TrimPrefix(a.URL, "http://"), extraHeaders)
+	res, err = http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.Nil(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(reader, echoed)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(echoed))
+}
+
+func TestLocalProxyForwardsEachRequest(t *testing.T) {
+	local := httptest.NewServer(&localProxyServer{})
+	defer local.Close()
+	requireForwardsEachRequest(t, local.Listener.Addr().String(), "")
+}
+
+func TestLocalProxyRoutesForwardedRequestsBySource(t *testing.T) {
+	r, err := parseRule("SRC-IP,127.0.0.1/32,REJECT", nil, nil, nil)
+	require.Nil(t, err)
+	local := httptest.NewServer(&localProxyServer{rules: ruleSet{r}})
+	defer local.Close()
+
+	target := newNamedServer(t, "a")
+	proxyURL, _ := url.Parse(local.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	res, err := client.Get(target.URL)
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestLocalProxyDoesNotShareUpstreamConnectionsBetweenClients(t *testing.T) {
+	r, err := parseRule("SRC-IP,127.0.0.2/32,REJECT", nil, nil, nil)
+	require.Nil(t, err)
+	local := httptest.NewServer(&localProxyServer{rules: ruleSet{r}})
+	defer local.Close()
+	target := newNamedServer(t, "a")
+	proxyURL, _ := url.Parse(local.URL)
+
+	clientFrom := func(ip string) *http.Client {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		return &http.Client{Transport: &http.Transport{
+			Proxy:       http.ProxyURL(proxyURL),
+			DialContext: dialer.DialContext,
+		}}
+	}
+
+	// the first client leaves an idle upstream connection to target behind
+	res, err := clientFrom("127.0.0.1").Get(target.URL)
+	require.Nil(t, err)
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = clientFrom("127.0.0.2").Get(target.URL)
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestLocalProxyStopClosesIdleUpstreamConnections(t *testing.T) {
+	var closed atomic.Int32
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Write([]byte("a"))
+	}))
+	target.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	target.Start()
+	defer target.Close()
+
+	proxy := &localProxyServer{}
+	local := httptest.NewServer(proxy)
+	defer local.Close()
+	proxyURL, _ := url.Parse(local.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	res, err := client.Get(target.URL)
+	require.Nil(t, err)
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the upstream connection is kept for the next request of the client
+	// until a reload stops the server
+	time.Sleep(50 * time.Millisecond)
+	require.EqualValues(t, 0, closed.Load())
+	proxy.stop()
+	require.Eventually(t, func() bool { return closed.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRemoteProxyForwardsEachRequest(t *testing.T) {
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+	requireForwardsEachRequest(t, remote.Listener.Addr().String(), headerSecret+": secret\r\n")
+}
+
+func TestForwardTransportTimesOutStalledOrigins(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				// /headers never answers, /body stalls in the middle
+				if req.URL.Path == "/body" {
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	timeouts := connTimeouts{idle: 200 * time.Millisecond}
+	client := &http.Client{Transport: newForwardTransport(timeouts.dialContext, timeouts)}
+	base := "http://" + listener.Addr().String()
+
+	start := time.Now()
+	_, err = client.Get(base + "/headers")
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), time.Second)
+
+	start = time.Now()
+	res, err := client.Get(base + "/body")
+	require.Nil(t, err)
+	defer res.Body.Close()
+	_, err = io.ReadAll(res.Body)
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// parseGFWList converts the base64 encoded GFWList, written in AdBlock
+// Plus syntax, into a domain matcher. Only the rules that name a domain are
+// kept: "||example.com", "|http://example.com/path", ".example.com" and
+// "example.com/path" all become the domain suffix example.com, and the
+// exception rules starting with "@@" are excluded. URL regular expressions
+// and wildcards cannot be applied to a CONNECT target and are skipped.
+func parseGFWList(data []byte) (*domainMatcher, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil {
+		return nil, err
+	}
+
+	m := newDomainMatcher()
+	scanner := bufio.NewScanner(bytes.NewReader(decoded))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		set := m.suffixes
+		if strings.HasPrefix(line, "@@") {
+			set = m.excludes
+			line = line[2:]
+		}
+		if domain := gfwListDomain(line); domain != "" {
+			set.add(domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func gfwListDomain(pattern string) string {
+	if strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		u, err := url.Parse(pattern[1:])
+		if err != nil {
+			return ""
+		}
+		pattern = u.Host
+	}
+	pattern = strings.TrimPrefix(pattern, ".")
+	if i := strings.IndexAny(pattern, "/^:"); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	if strings.ContainsAny(pattern, "*%") || !strings.Contains(pattern, ".") || net.ParseIP(pattern) != nil {
+		return ""
+	}
+	return normalizeDomain(pattern)
+}
+
+// parseDnsmasqList reads dnsmasq configuration such as the
+// dnsmasq-china-list files, where every line names domains between slashes:
+// "server=/example.com/114.114.114.114".
+func parseDnsmasqList(data []byte) *domainMatcher {
+	m := newDomainMatcher()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, value, found := strings.Cut(line, "=")
+		if !found || !strings.HasPrefix(value, "/") {
+			continue
+		}
+		parts := strings.Split(value, "/")
+		// parts[0] is empty and the last part is the server or address.
+		for _, domain := range parts[1 : len(parts)-1] {
+			if domain != "" {
+				m.suffixes.add(normalizeDomain(domain))
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGFWList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://www.youtube.com/watch
+.twitter.com
+facebook.com/login
+@@||cn.google.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+*.wikipedia.org
+1.2.3.4
+`
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	// the published file wraps the base64 text every 64 characters
+	var wrapped string
+	for len(encoded) > 64 {
+		wrapped += encoded[:64] + "\n"
+		encoded = encoded[64:]
+	}
+	wrapped += encoded + "\n"
+
+	m, err := parseGFWList([]byte(wrapped))
+	require.Nil(t, err)
+	require.True(t, m.match("www.google.com"))
+	require.True(t, m.match("www.youtube.com"))
+	require.True(t, m.match("api.twitter.com"))
+	require.True(t, m.match("facebook.com"))
+	require.False(t, m.match("cn.google.com"))
+	require.False(t, m.match("en.wikipedia.org"))
+	require.False(t, m.match("www.baidu.com"))
+
+	_, err = parseGFWList([]byte("not base64!"))
+	require.NotNil(t, err)
+}
+
+func TestParseDnsmasqList(t *testing.T) {
+	m := parseDnsmasqList([]byte(`# comment
+server=/baidu.com/114.114.114.114
+server=/qq.com/taobao.com/114.114.114.114
+ipset=/163.com/chnroute
+no-resolv
+`))
+	require.True(t, m.match("www.baidu.com"))
+	require.True(t, m.match("qq.com"))
+	require.True(t, m.match("world.taobao.com"))
+	require.True(t, m.match("mail.163.com"))
+	require.False(t, m.match("google.com"))
+}
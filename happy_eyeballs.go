@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	ipPreferV4 = "prefer-v4"
+	ipPreferV6 = "prefer-v6"
+	ipV4Only   = "v4-only"
+
+	// happyEyeballsAttemptDelay is the Connection Attempt Delay recommended
+	// by RFC 8305.
+	happyEyeballsAttemptDelay = 250 * time.Millisecond
+
+	// happyEyeballsResolutionDelay is the Resolution Delay recommended by
+	// RFC 8305: how long the answer of the preferred address family is waited
+	// for once the other family has answered.
+	happyEyeballsResolutionDelay = 50 * time.Millisecond
+)
+
+func parseIPPreference(preference string) (string, error) {
+	switch preference {
+	case ipPreferV4, ipPreferV6, ipV4Only:
+		return preference, nil
+	}
+	return "", fmt.Errorf("unknown IP preference %q, expect %s, %s or %s", preference, ipPreferV4, ipPreferV6, ipV4Only)
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// sortAddresses orders ips as described in RFC 8305 section 4: addresses of
+// the preferred family and of the other family alternate, starting with the
+// preferred one. With v4-only, IPv6 addresses are dropped.
+func sortAddresses(ips []net.IP, preference string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if isIPv4(ip) {
+			v4 = append(v4, ip)
+		} else if preference != ipV4Only {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v4, v6
+	if preference == ipPreferV6 {
+		first, second = v6, v4
+	}
+	return interleaveAddresses(first, second)
+}
+
+// interleaveAddresses alternates the addresses of first and second,
+// starting with first.
+func interleaveAddresses(first, second []net.IP) []net.IP {
+	sorted := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialHappyEyeballs connects to port on the first of ips that answers. A new
+// attempt starts whenever the previous one fails or has not succeeded within
+// happyEyeballsAttemptDelay, so a dead address only costs the delay instead
+// of a full connect timeout. The connections that lose are closed.
+//
+// late, which may be nil, delivers the addresses of the address family that
+// was resolved after the attempts started. They are interleaved with the
+// addresses not tried yet and join the race from then on.
+func dialHappyEyeballs(ips []net.IP, late <-chan []net.IP, port string, dialer *net.Dialer) (net.Conn, error) {
+	if len(ips) == 0 && late == nil {
+		return nil, fmt.Errorf("no address to dial")
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(ips))
+	next := 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		go func() {
+			conn, err := dialer.Dial("tcp", addr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	pending := 0
+	timer := time.NewTimer(happyEyeballsAttemptDelay)
+	defer timer.Stop()
+	// waiting is set while the next attempt is due but there is no address
+	// left to try.
+	waiting := true
+	startNext := func() {
+		if next < len(ips) {
+			start()
+			pending++
+			waiting = false
+			timer.Reset(happyEyeballsAttemptDelay)
+		} else {
+			waiting = true
+		}
+	}
+	startNext()
+
+	var firstErr error
+	for pending > 0 || late != nil {
+		select {
+		case <-timer.C:
+			startNext()
+		case more, ok := <-late:
+			if !ok {
+				late = nil
+				continue
+			}
+			ips = append(ips[:next:next], interleaveAddresses(ips[next:], more)...)
+			if waiting {
+				startNext()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			startNext()
+		}
+	}
+	if firstErr == nil {
+		return nil, fmt.Errorf("no address to dial")
+	}
+	return nil, firstErr
+}
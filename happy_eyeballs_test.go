@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func parseIPs(values ...string) []net.IP {
+	var ips []net.IP
+	for _, v := range values {
+		ips = append(ips, net.ParseIP(v))
+	}
+	return ips
+}
+
+func TestSortAddresses(t *testing.T) {
+	ips := parseIPs("1.1.1.1", "2.2.2.2", "2001::1", "2001::2", "3.3.3.3")
+
+	require.Equal(t, parseIPs("1.1.1.1", "2001::1", "2.2.2.2", "2001::2", "3.3.3.3"), sortAddresses(ips, ipPreferV4))
+	require.Equal(t, parseIPs("2001::1", "1.1.1.1", "2001::2", "2.2.2.2", "3.3.3.3"), sortAddresses(ips, ipPreferV6))
+	require.Equal(t, parseIPs("1.1.1.1", "2.2.2.2", "3.3.3.3"), sortAddresses(ips, ipV4Only))
+}
+
+func TestParseIPPreference(t *testing.T) {
+	_, err := parseIPPreference(ipPreferV6)
+	require.Nil(t, err)
+	_, err = parseIPPreference("v6-only")
+	require.NotNil(t, err)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// ::1 is not listening on the port, so the IPv4 attempt has to win.
+	start := time.Now()
+	conn, err := dialHappyEyeballs(parseIPs("::1", "127.0.0.1"), nil, port, &net.Dialer{Timeout: time.Second})
+	require.Nil(t, err)
+	requireEcho(t, conn)
+	conn.Close()
+	require.Less(t, time.Since(start), time.Second)
+
+	_, deadPort, _ := net.SplitHostPort(newDeadAddr(t))
+	_, err = dialHappyEyeballs(parseIPs("127.0.0.1"), nil, deadPort, &net.Dialer{Timeout: time.Second})
+	require.NotNil(t, err)
+
+	_, err = dialHappyEyeballs(nil, nil, port, &net.Dialer{Timeout: time.Second})
+	require.NotNil(t, err)
+}
+
+// resolveAll returns the addresses resolve returns first and those it
+// delivers later.
+func resolveAll(local *localProxyServer, host string) ([]net.IP, []net.IP) {
+	ips, late := local.resolve(host)
+	var lateIPs []net.IP
+	if late != nil {
+		for more := range late {
+			lateIPs = append(lateIPs, more...)
+		}
+	}
+	return ips, lateIPs
+}
+
+func TestLocalProxyResolve(t *testing.T) {
+	local := &localProxyServer{
+		dns: staticResolver{
+			"example.com": parseIPs("93.184.216.34", "2606:2800:220:1::"),
+		},
+	}
+	ips, late := resolveAll(local, "example.com")
+	require.Equal(t, parseIPs("93.184.216.34", "2606:2800:220:1::"), append(ips, late...))
+
+	local.ipPreference = ipPreferV6
+	ips, late = resolveAll(local, "example.com")
+	require.Equal(t, parseIPs("2606:2800:220:1::", "93.184.216.34"), append(ips, late...))
+
+	local.ipPreference = ipV4Only
+	ips, late = resolveAll(local, "example.com")
+	require.Equal(t, parseIPs("93.184.216.34"), ips)
+	require.Empty(t, late)
+	ips, _ = resolveAll(local, "::1")
+	require.Equal(t, parseIPs("::1"), ips)
+	ips, late = resolveAll(local, "example.org")
+	require.Empty(t, ips)
+	require.Empty(t, late)
+}
+
+// slowAAAAResolver answers A queries at once and AAAA queries once release
+// is closed.
+type slowAAAAResolver struct {
+	release chan struct{}
+}
+
+func (r slowAAAAResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+	if qtype == dns.TypeA {
+		return nil, []dnsRecord{{ip: net.ParseIP("127.0.0.1"), expiredAt: time.Now().Add(time.Minute)}}
+	}
+	<-r.release
+	return nil, []dnsRecord{{ip: net.ParseIP("::1"), expiredAt: time.Now().Add(time.Minute)}}
+}
+
+func (r slowAAAAResolver) name() string {
+	return "slowAAAAResolver"
+}
+
+func TestLocalProxyResolveDoesNotWaitForTheOtherFamily(t *testing.T) {
+	resolver := slowAAAAResolver{release: make(chan struct{})}
+	local := &localProxyServer{dns: resolver}
+
+	ips, late := local.resolve("example.com")
+	require.Equal(t, parseIPs("127.0.0.1"), ips)
+	require.NotNil(t, late)
+	close(resolver.release)
+	require.Equal(t, parseIPs("::1"), <-late)
+
+	// the preferred family is waited for a little when the other one answers
+	// first
+	resolver = slowAAAAResolver{release: make(chan struct{})}
+	local = &localProxyServer{dns: resolver, ipPreference: ipPreferV6}
+	start := time.Now()
+	ips, late = local.resolve("example.com")
+	require.Equal(t, parseIPs("127.0.0.1"), ips)
+	require.GreaterOrEqual(t, time.Since(start), happyEyeballsResolutionDelay)
+	close(resolver.release)
+	require.Equal(t, parseIPs("::1"), <-late)
+}
+
+func TestDialHappyEyeballsWithLateAddresses(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// the first address is dead, the one of the other family arrives later
+	late := make(chan []net.IP, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		late <- parseIPs("127.0.0.1")
+		close(late)
+	}()
+	conn, err := dialHappyEyeballs(parseIPs("127.0.0.2"), late, port, &net.Dialer{Timeout: time.Second})
+	require.Nil(t, err)
+	requireEcho(t, conn)
+	conn.Close()
+
+	closed := make(chan []net.IP)
+	close(closed)
+	_, err = dialHappyEyeballs(nil, closed, port, &net.Dialer{Timeout: time.Second})
+	require.NotNil(t, err)
+}
@@ -2,8 +2,9 @@ package main
 
 import (
     "bufio"
+    "bytes"
     "context"
-    "crypto/tls"
+    "encoding/json"
     "errors"
     "fmt"
     "io"
@@ -11,10 +12,14 @@ import (
     "math"
     "net"
     "net/http"
-    "net/url"
+    "net/http/httputil"
     "sort"
     "strconv"
     "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
 )
 
 const (
@@ -22,89 +27,657 @@ const (
 )
 
 type localProxyServer struct {
-    remoteProxyAddr           *url.URL
-    secretKey                 string
+    remoteProxy               tunnelDialer
     chinaIPRangeDB            *iPRangeDB
     forceForwardToRemoteProxy bool
     client                    *http.Client
     dns                       dnsResovler
+    directDomains             domainSet
+    remoteDomains             domainSet
+    pac                       *pacFile
+    users                     userDB
+    accessList                *accessList
+    selectGroups              map[string]*remoteProxySelect
+    fallbackToRemote          bool
+    fallbackToDirect          bool
+    directDialTimeout         time.Duration
+    routes                    *routeMemory
+    raceDirectAndRemote       bool
+    raceDelay                 time.Duration
+    ipPreference              string
+    rules                     ruleSet
+    blockList                 *blockList
+    resolveOnRemote           bool
+    fakeIPs                   *fakeIPPool
+    remotes                   []*remoteProxyClient
+    ruleProviders             []*ruleProvider
+    dnsUpstream               dnsExchanger
+    healthChecker             *remoteProxyHealthChecker
+    pendingLists              []pendingList
+    stopBackground            context.CancelFunc
+    tunnels                   *tunnelTracker
+    timeouts                  connTimeouts
+
+    forwarderOnce sync.Once
+    forwarder     *httputil.ReverseProxy
 }
 
 func (proxy *localProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-    targetAddr := appendPort(req.Host, req.URL.Scheme)
-    host, port, _ := net.SplitHostPort(targetAddr)
+    if !proxy.accessList.allowedAddr(req.RemoteAddr) {
+        log.Printf("deny client %s", req.RemoteAddr)
+        http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+        return
+    }
 
-    if proxy.forceForwardToRemoteProxy {
-        proxy.forwardToRemoteProxy(rw, req)
+    if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+        proxy.serveLocal(rw, req)
         return
     }
 
-    var err error
-    targetIP := net.ParseIP(host)
-    if targetIP == nil {
-        if err, targetIP, _ = proxy.dns.lookup(host); err != nil {
-            log.Printf("resolve %s error: %v", host, err)
+    if len(proxy.users) > 0 {
+        if !proxy.users.verifyBasicAuthorization(req.Header.Get("Proxy-Authorization")) {
+            rw.Header().Set("Proxy-Authenticate", `Basic realm="sandwich"`)
+            http.Error(rw, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+            return
         }
+        req.Header.Del("Proxy-Authorization")
     }
-    if targetIP == nil {
-        http.Error(rw, fmt.Sprintf("lookup %s: no such host", host), http.StatusServiceUnavailable)
+
+    if req.Method != http.MethodConnect {
+        proxy.forwardProxy().ServeHTTP(rw, withSrcAddr(req))
         return
     }
 
-    req.URL.Host = targetIP.String() + ":" + port
-    if proxy.chinaIPRangeDB.contains(targetIP) || privateIPRange.contains(targetIP) {
-        log.Println(fmt.Sprintf("origin <-> local <-> %s(%s)", host, targetIP))
-        proxy.forwardToTarget(rw, req, targetAddr)
+    // the client is tracked from now on, so that a shutdown does not miss
+    // it between the HTTP server letting go of it and the tunnel starting
+    defer proxy.tunnels.accept(nil)()
+
+    targetAddr := appendPort(req.Host, req.URL.Scheme)
+    host, port, _ := net.SplitHostPort(targetAddr)
+
+    if ip := net.ParseIP(host); ip != nil && !proxy.fakeIPs.contains(ip) {
+        proxy.serveSniffedConnect(rw, req, host, port)
         return
     }
 
-    log.Println(fmt.Sprintf("origin <-> local <-> remote <-> %s(%s)", host, targetIP))
-    proxy.forwardToRemoteProxy(rw, req)
+    target, err := proxy.connect(req.RemoteAddr, host, port)
+    if errors.Is(err, errRejected) || errors.Is(err, errBlocked) {
+        http.Error(rw, err.Error(), http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+
+    client := hijack(rw)
+    client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+
+    proxy.tunnels.relay(client, target)
 }
 
-func (proxy *localProxyServer) forwardToTarget(rw http.ResponseWriter, req *http.Request, targetAddr string) {
-    client, _, _ := rw.(http.Hijacker).Hijack()
-    target, err := net.Dial("tcp", targetAddr)
+// forwardProxy returns the proxy for plain HTTP requests, which routes
+// every upstream connection through connect like a CONNECT tunnel. Upstream
+// connections are only reused for the client they were routed for.
+func (proxy *localProxyServer) forwardProxy() *httputil.ReverseProxy {
+    proxy.forwarderOnce.Do(func() {
+        dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+            host, port, err := net.SplitHostPort(addr)
+            if err != nil {
+                return nil, err
+            }
+            return proxy.connect(requestSrcAddr(ctx), host, port)
+        }
+        proxy.forwarder = newForwardProxy(newClientTransports(256, func() *http.Transport {
+            return newForwardTransport(dial, proxy.timeouts)
+        }))
+    })
+    return proxy.forwarder
+}
+
+// serveSniffedConnect serves a CONNECT to an IP address, which would leave
+// only the IP for routing. The tunnel is acknowledged before connecting, so
+// that the host name can be sniffed from the TLS ClientHello or the HTTP
+// Host header. The sniffed name only chooses the route, a direct connection
+// still goes to the IP the client asked for.
+func (proxy *localProxyServer) serveSniffedConnect(rw http.ResponseWriter, req *http.Request, ip, port string) {
+    client := hijack(rw)
+    defer proxy.tunnels.accept(client)()
+    client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+
+    host, client := sniffHost(client)
+    target, err := proxy.connectSniffed(req.RemoteAddr, host, net.ParseIP(ip), port)
     if err != nil {
-        http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+        log.Printf("connect %s(%s) error: %v", net.JoinHostPort(ip, port), host, err)
+        client.Close()
         return
     }
 
-    if req.Method == http.MethodConnect {
-        client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
-    } else {
-        if v := req.Header.Get("Proxy-Connection"); v != "" {
-            req.Header.Del("Proxy-Connection")
-            req.Header.Set("Connection", v)
+    proxy.tunnels.relay(client, target)
+}
+
+// hijack takes over the client connection, including whatever the client
+// already sent after the request, such as a ClientHello pipelined behind
+// CONNECT.
+func hijack(rw http.ResponseWriter) net.Conn {
+    client, buf, _ := rw.(http.Hijacker).Hijack()
+    if n := buf.Reader.Buffered(); n > 0 {
+        peeked, _ := buf.Reader.Peek(n)
+        return &bufferedConn{Conn: client, reader: io.MultiReader(bytes.NewReader(peeked), client)}
+    }
+    return client
+}
+
+// serveLocal serves requests addressed to the local proxy itself rather
+// than proxied through it.
+func (proxy *localProxyServer) serveLocal(rw http.ResponseWriter, req *http.Request) {
+    switch {
+    case req.URL.Path == "/proxy.pac" || req.URL.Path == "/wpad.dat":
+        if proxy.pac != nil {
+            proxy.pac.ServeHTTP(rw, req)
+            return
+        }
+    case strings.HasPrefix(req.URL.Path, "/proxy-groups"):
+        if proxy.authorizeLocal(rw, req) {
+            proxy.serveProxyGroups(rw, req)
+        }
+        return
+    case req.URL.Path == "/stats":
+        if proxy.authorizeLocal(rw, req) {
+            proxy.serveStats(rw, req)
         }
-        req.Write(target)
+        return
+    }
+    http.NotFound(rw, req)
+}
+
+// authorizeLocal checks the Basic Authorization of requests to the local
+// APIs when users are configured, and answers 401 if it fails.
+func (proxy *localProxyServer) authorizeLocal(rw http.ResponseWriter, req *http.Request) bool {
+    if len(proxy.users) > 0 && !proxy.users.verifyBasicAuthorization(req.Header.Get("Authorization")) {
+        rw.Header().Set("WWW-Authenticate", `Basic realm="sandwich"`)
+        http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+        return false
     }
+    return true
+}
 
-    go transfer(client, target)
-    transfer(target, client)
+type localProxyStats struct {
+    Tunnels *tunnelStats    `json:"tunnels,omitempty"`
+    Blocked *blockListStats `json:"blocked,omitempty"`
 }
 
-func (proxy *localProxyServer) forwardToRemoteProxy(rw http.ResponseWriter, req *http.Request) {
-    client, _, _ := rw.(http.Hijacker).Hijack()
-    var remoteProxy net.Conn
-    var err error
+// serveStats reports the counters of the local proxy on GET /stats.
+func (proxy *localProxyServer) serveStats(rw http.ResponseWriter, req *http.Request) {
+    var stats localProxyStats
+    if proxy.tunnels != nil {
+        tunnels := proxy.tunnels.stats()
+        stats.Tunnels = &tunnels
+    }
+    if proxy.blockList != nil {
+        blocked := proxy.blockList.stats()
+        stats.Blocked = &blocked
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(stats)
+}
 
-    remoteProxyAddr := appendPort(proxy.remoteProxyAddr.Host, proxy.remoteProxyAddr.Scheme)
+type proxyGroupStatus struct {
+    Now string   `json:"now"`
+    All []string `json:"all"`
+}
 
-    if proxy.remoteProxyAddr.Scheme == "https" {
-        remoteProxy, err = tls.Dial("tcp", remoteProxyAddr, nil)
-    } else {
-        remoteProxy, err = net.Dial("tcp", remoteProxyAddr)
+// serveProxyGroups lists select groups on GET /proxy-groups and switches
+// the member of a group on PUT /proxy-groups/<name> with {"name": "..."}.
+func (proxy *localProxyServer) serveProxyGroups(rw http.ResponseWriter, req *http.Request) {
+    name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/proxy-groups"), "/")
+    if name == "" && req.Method == http.MethodGet {
+        groups := make(map[string]proxyGroupStatus, len(proxy.selectGroups))
+        for name, group := range proxy.selectGroups {
+            groups[name] = proxyGroupStatus{Now: group.now(), All: group.memberNames()}
+        }
+        rw.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(rw).Encode(groups)
+        return
     }
-    if err != nil {
+
+    group, ok := proxy.selectGroups[name]
+    if !ok {
+        http.NotFound(rw, req)
+        return
+    }
+    if req.Method != http.MethodPut {
+        rw.Header().Set("Allow", http.MethodPut)
+        http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        Name string `json:"name"`
+    }
+    if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+        http.Error(rw, "decode request body error: "+err.Error(), http.StatusBadRequest)
         return
     }
+    if err := group.choose(body.Name); err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+    rw.WriteHeader(http.StatusNoContent)
+}
+
+// connect opens a connection to host:port, either directly or through the
+// remote proxy depending on where host resolves to. It is shared by every
+// inbound protocol so they all make the same routing decision.
+func (proxy *localProxyServer) connect(srcAddr, host, port string) (net.Conn, error) {
+    return proxy.connectTo(srcAddr, host, nil, port)
+}
+
+// connectSniffed opens a connection to ip:port that was asked for by IP,
+// routed as if to host, the name sniffed from the client. host only chooses
+// the route and is passed to the remote proxy; a direct connection goes to
+// ip, so that clients pinning addresses or resolving through their own DNS
+// are not sent elsewhere. Without a sniffed name it is connect to ip.
+func (proxy *localProxyServer) connectSniffed(srcAddr, host string, ip net.IP, port string) (net.Conn, error) {
+    if host == "" || net.ParseIP(host) != nil {
+        return proxy.connect(srcAddr, ip.String(), port)
+    }
+    log.Printf("sniffed %s from %s", host, net.JoinHostPort(ip.String(), port))
+    return proxy.connectTo(srcAddr, host, []net.IP{ip}, port)
+}
+
+// connectTo is connect with the addresses of host already known when
+// targetIPs is not nil. A fake IP is mapped back to its domain, which is then
+// routed as with resolveOnRemote: domains not known to be in China are
+// passed to the remote proxy by name, so that fake-IP mode alone keeps them
+// off local DNS.
+func (proxy *localProxyServer) connectTo(srcAddr, host string, targetIPs []net.IP, port string) (net.Conn, error) {
+    resolveOnRemote := proxy.resolveOnRemote
+    if ip := net.ParseIP(host); proxy.fakeIPs.contains(ip) {
+        domain, ok := proxy.fakeIPs.lookupHost(ip)
+        if !ok {
+            return nil, fmt.Errorf("fake IP %s is not mapped to any domain", host)
+        }
+        host = domain
+        resolveOnRemote = true
+    }
+    targetAddr := net.JoinHostPort(host, port)
+
+    if proxy.blockList.blocked(host, "proxy") {
+        log.Printf("block %s", host)
+        return nil, errBlocked
+    }
+
+    if len(proxy.rules) > 0 {
+        portNum, _ := strconv.Atoi(port)
+        target := &ruleTarget{
+            srcIP:     addrIP(srcAddr),
+            host:      host,
+            port:      portNum,
+            resolve:   proxy.resolve,
+            noResolve: resolveOnRemote && targetIPs == nil,
+            ips:       targetIPs,
+            resolved:  targetIPs != nil,
+        }
+        if r := proxy.rules.match(target); r != nil {
+            return proxy.connectByRule(r, target, port)
+        }
+    }
+
+    if proxy.forceForwardToRemoteProxy || proxy.remoteDomains.contains(host) {
+        log.Println(fmt.Sprintf("origin <-> local <-> remote <-> %s", host))
+        return proxy.forwardToRemoteProxy(targetAddr)
+    }
+
+    if resolveOnRemote && net.ParseIP(host) == nil && !proxy.knownChinaDomain(host) {
+        log.Println(fmt.Sprintf("origin <-> local <-> remote <-> %s", host))
+        return proxy.forwardToRemoteProxy(targetAddr)
+    }
+
+    var late <-chan []net.IP
+    if targetIPs == nil {
+        targetIPs, late = proxy.resolve(host)
+    }
+    if len(targetIPs) == 0 {
+        return nil, fmt.Errorf("lookup %s: no such host", host)
+    }
+
+    if proxy.directDomains.contains(host) {
+        log.Println(fmt.Sprintf("origin <-> local <-> %s%v", host, targetIPs))
+        return proxy.forwardToTarget(targetIPs, late, port)
+    }
+
+    // every address is checked on its own, only those in the China or
+    // private IP ranges are dialed directly. The late addresses of the other
+    // family are checked the same way when they arrive.
+    var directIPs, privateIPs []net.IP
+    for _, ip := range targetIPs {
+        switch {
+        case privateIPRange.contains(ip):
+            privateIPs = append(privateIPs, ip)
+        case proxy.chinaIPRangeDB.contains(ip):
+            directIPs = append(directIPs, ip)
+        }
+    }
+    if len(privateIPs) > 0 {
+        log.Println(fmt.Sprintf("origin <-> local <-> %s%v", host, privateIPs))
+        return proxy.forwardToTarget(privateIPs, filterIPs(late, privateIPRange.contains), port)
+    }
+    if len(directIPs) > 0 {
+        return proxy.connectWithFallback(host, directIPs, filterIPs(late, proxy.chinaIPRangeDB.contains), port, routeDirect)
+    }
 
-    req.Header.Set(headerSecret, proxy.secretKey)
-    req.Write(remoteProxy)
+    if proxy.raceDirectAndRemote && proxy.routes.get(host) == 0 {
+        return proxy.race(host, targetIPs, late, port)
+    }
+    return proxy.connectWithFallback(host, targetIPs, late, port, routeRemote)
+}
 
-    go transfer(remoteProxy, client)
-    transfer(client, remoteProxy)
+// knownChinaDomain reports whether host is known to be served in China
+// without resolving it: it is in the direct domains or under the .cn TLD.
+func (proxy *localProxyServer) knownChinaDomain(host string) bool {
+    return proxy.directDomains.contains(host) || strings.HasSuffix(normalizeDomain(host), ".cn")
+}
+
+// connectByRule connects to the target the way the matched rule says.
+func (proxy *localProxyServer) connectByRule(r *rule, target *ruleTarget, port string) (net.Conn, error) {
+    if r.action.remote != nil {
+        log.Println(fmt.Sprintf("origin <-> local <-> %s <-> %s [%s]", r.action.remote.name(), target.host, r))
+        return r.action.remote.dialTunnel(net.JoinHostPort(target.host, port))
+    }
+    if r.action.name == ruleActionReject {
+        log.Printf("reject %s [%s]", target.host, r)
+        return nil, errRejected
+    }
+
+    targetIPs := target.targetIPs()
+    if len(targetIPs) == 0 {
+        return nil, fmt.Errorf("lookup %s: no such host", target.host)
+    }
+    log.Println(fmt.Sprintf("origin <-> local <-> %s%v [%s]", target.host, targetIPs, r))
+    return proxy.forwardToTarget(targetIPs, target.late, port)
+}
+
+// resolve returns the addresses of host in the order they should be dialed.
+// Both A and AAAA records are looked up unless the preference is v4-only.
+// As described in RFC 8305 section 3, it returns as soon as the preferred
+// family has answered, or the other one has and the preferred one does not
+// follow within happyEyeballsResolutionDelay, so that a slow or failing
+// lookup of one family does not hold up the connection. The addresses of the
+// family that answers later are delivered by late, which is nil when all
+// addresses are already known.
+func (proxy *localProxyServer) resolve(host string) (ips []net.IP, late <-chan []net.IP) {
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ip}, nil
+    }
+
+    qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+    if proxy.ipPreference == ipV4Only {
+        qtypes = qtypes[:1]
+    }
+    preferred := dns.TypeA
+    if proxy.ipPreference == ipPreferV6 {
+        preferred = dns.TypeAAAA
+    }
+
+    type answer struct {
+        qtype uint16
+        ips   []net.IP
+    }
+    answers := make(chan answer, len(qtypes))
+    for _, qtype := range qtypes {
+        go func(qtype uint16) {
+            err, records := proxy.dns.lookup(host, qtype)
+            if err != nil {
+                log.Printf("resolve %s %s error: %v", host, dns.TypeToString[qtype], err)
+            }
+            a := answer{qtype: qtype}
+            for _, record := range records {
+                a.ips = append(a.ips, record.ip)
+            }
+            answers <- a
+        }(qtype)
+    }
+    lateAnswer := func() <-chan []net.IP {
+        late := make(chan []net.IP, 1)
+        go func() {
+            if a := <-answers; len(a.ips) > 0 {
+                late <- a.ips
+            }
+            close(late)
+        }()
+        return late
+    }
+
+    var resolutionDelay <-chan time.Time
+    for pending := len(qtypes); pending > 0; {
+        var a answer
+        select {
+        case a = <-answers:
+        case <-resolutionDelay:
+            return sortAddresses(ips, proxy.ipPreference), lateAnswer()
+        }
+        pending--
+        ips = append(ips, a.ips...)
+        if len(ips) == 0 || pending == 0 {
+            continue
+        }
+        if a.qtype == preferred {
+            return sortAddresses(ips, proxy.ipPreference), lateAnswer()
+        }
+        timer := time.NewTimer(happyEyeballsResolutionDelay)
+        defer timer.Stop()
+        resolutionDelay = timer.C
+    }
+    return sortAddresses(ips, proxy.ipPreference), nil
+}
+
+// filterIPs delivers the addresses from late that keep accepts.
+func filterIPs(late <-chan []net.IP, keep func(ip net.IP) bool) <-chan []net.IP {
+    if late == nil {
+        return nil
+    }
+    filtered := make(chan []net.IP, 1)
+    go func() {
+        defer close(filtered)
+        var kept []net.IP
+        for ips := range late {
+            for _, ip := range ips {
+                if keep(ip) {
+                    kept = append(kept, ip)
+                }
+            }
+        }
+        if len(kept) > 0 {
+            filtered <- kept
+        }
+    }()
+    return filtered
+}
+
+// connectWithFallback dials through the preferred route and, if that fails
+// and fallback is enabled for it, through the other one. A route that only
+// worked as the fallback is remembered for the host and tried first until
+// the memory expires.
+func (proxy *localProxyServer) connectWithFallback(host string, targetIPs []net.IP, late <-chan []net.IP, port string, preferred route) (net.Conn, error) {
+    remembered := proxy.routes.get(host)
+    routes := []route{preferred}
+    if remembered == preferred.other() || proxy.canFallback(preferred) {
+        routes = append(routes, preferred.other())
+    }
+    if remembered == preferred.other() {
+        routes[0], routes[1] = routes[1], routes[0]
+    }
+
+    var firstErr error
+    for i, r := range routes {
+        conn, err := proxy.dialRoute(r, host, targetIPs, late, port)
+        if err == nil {
+            if r != remembered {
+                if r == preferred {
+                    proxy.routes.forget(host)
+                } else {
+                    proxy.routes.remember(host, r)
+                }
+            }
+            return conn, nil
+        }
+        if i+1 < len(routes) {
+            log.Printf("connect %s via %s error: %v, fall back to %s", host, r, err, routes[i+1])
+        }
+        if firstErr == nil {
+            firstErr = err
+        }
+    }
+    proxy.routes.forget(host)
+    return nil, firstErr
+}
+
+// race dials the target directly and, if that has not succeeded within
+// raceDelay, through the remote proxy as well. The first established
+// connection wins, the other one is closed, and the winner is remembered for
+// the host so that the next connections skip the race. A direct winner is
+// only remembered once the target has answered, see raceWinnerConn.
+func (proxy *localProxyServer) race(host string, targetIPs []net.IP, late <-chan []net.IP, port string) (net.Conn, error) {
+    type raceResult struct {
+        route route
+        conn  net.Conn
+        err   error
+    }
+    results := make(chan raceResult, 2)
+    dial := func(r route) {
+        conn, err := proxy.dialRoute(r, host, targetIPs, late, port)
+        results <- raceResult{route: r, conn: conn, err: err}
+    }
+
+    go dial(routeDirect)
+    pending := 1
+
+    timer := time.NewTimer(proxy.raceDelay)
+    defer timer.Stop()
+    startRemote := timer.C
+
+    var firstErr error
+    for pending > 0 {
+        select {
+        case <-startRemote:
+            startRemote = nil
+            go dial(routeRemote)
+            pending++
+        case res := <-results:
+            pending--
+            if res.err != nil {
+                if firstErr == nil {
+                    firstErr = res.err
+                }
+                if startRemote != nil {
+                    startRemote = nil
+                    go dial(routeRemote)
+                    pending++
+                }
+                continue
+            }
+
+            log.Printf("race %s: %s won", host, res.route)
+            if res.route == routeDirect {
+                res.conn = &raceWinnerConn{Conn: res.conn, routes: proxy.routes, host: host}
+            } else {
+                proxy.routes.remember(host, res.route)
+            }
+            go func(pending int) {
+                for ; pending > 0; pending-- {
+                    if loser := <-results; loser.conn != nil {
+                        loser.conn.Close()
+                    }
+                }
+            }(pending)
+            return res.conn, nil
+        }
+    }
+    return nil, firstErr
+}
+
+// raceWinnerConn is a direct connection that won a race. Sites blocked by
+// SNI accept the TCP connection and reset it at the TLS handshake, so the
+// direct route is only remembered once the target has sent data. If the
+// connection fails before that, the remote proxy is remembered instead, so
+// that the next connections to the host do not race into the reset again.
+type raceWinnerConn struct {
+    net.Conn
+    routes *routeMemory
+    host   string
+    once   sync.Once
+}
+
+func (c *raceWinnerConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    if n > 0 {
+        c.once.Do(func() {
+            c.routes.remember(c.host, routeDirect)
+        })
+    } else if err != nil && !errors.Is(err, net.ErrClosed) {
+        c.once.Do(func() {
+            log.Printf("race %s: direct connection failed before any data: %v, remember remote", c.host, err)
+            c.routes.remember(c.host, routeRemote)
+        })
+    }
+    return n, err
+}
+
+// WriteTo reads through Read until the route is decided and then copies
+// from the underlying connection, so that io.Copy can still splice.
+func (c *raceWinnerConn) WriteTo(w io.Writer) (int64, error) {
+    var written int64
+    buf := make([]byte, 32*1024)
+    for {
+        n, err := c.Read(buf)
+        if n > 0 {
+            m, werr := w.Write(buf[:n])
+            written += int64(m)
+            if werr != nil {
+                return written, werr
+            }
+            break
+        }
+        if err == io.EOF {
+            return written, nil
+        }
+        if err != nil {
+            return written, err
+        }
+    }
+    n, err := io.Copy(w, c.Conn)
+    return written + n, err
+}
+
+func (proxy *localProxyServer) canFallback(from route) bool {
+    if from == routeDirect {
+        return proxy.fallbackToRemote
+    }
+    return proxy.fallbackToDirect
+}
+
+func (proxy *localProxyServer) dialRoute(r route, host string, targetIPs []net.IP, late <-chan []net.IP, port string) (net.Conn, error) {
+    if r == routeDirect {
+        log.Println(fmt.Sprintf("origin <-> local <-> %s%v", host, targetIPs))
+        return proxy.forwardToTarget(targetIPs, late, port)
+    }
+    log.Println(fmt.Sprintf("origin <-> local <-> remote <-> %s%v", host, targetIPs))
+    return proxy.forwardToRemoteProxy(net.JoinHostPort(host, port))
+}
+
+// forwardToTarget connects directly to the first of targetIPs, or of the
+// addresses delivered by late, that answers.
+func (proxy *localProxyServer) forwardToTarget(targetIPs []net.IP, late <-chan []net.IP, port string) (net.Conn, error) {
+    dialer := proxy.timeouts.dialer()
+    dialer.Timeout = proxy.directDialTimeout
+    conn, err := dialHappyEyeballs(targetIPs, late, port, dialer)
+    proxy.timeouts.countDial(fmt.Sprintf("%v port %s", targetIPs, port), err)
+    return conn, err
+}
+
+func (proxy *localProxyServer) forwardToRemoteProxy(targetAddr string) (net.Conn, error) {
+    return proxy.remoteProxy.dialTunnel(targetAddr)
 }
 
 func (proxy *localProxyServer) pullLatestIPRange(ctx context.Context) error {
@@ -164,10 +737,14 @@ func (proxy *localProxyServer) pullLatestIPRange(ctx context.Context) error {
     }
 
     proxy.chinaIPRangeDB.Lock()
-    defer proxy.chinaIPRangeDB.Unlock()
     proxy.chinaIPRangeDB.db = db
     proxy.chinaIPRangeDB.init()
     sort.Sort(proxy.chinaIPRangeDB)
+    proxy.chinaIPRangeDB.Unlock()
+
+    if proxy.pac != nil {
+        proxy.pac.update()
+    }
     return nil
 }
 
@@ -177,6 +754,17 @@ func transfer(dst io.WriteCloser, src io.ReadCloser) {
     io.Copy(dst, src)
 }
 
+// bufferedConn is a net.Conn whose first bytes have already been read, e.g.
+// while parsing a handshake, and are replayed by reader.
+type bufferedConn struct {
+    net.Conn
+    reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.reader.Read(p)
+}
+
 func appendPort(host string, schema string) string {
     if strings.Index(host, ":") < 0 || strings.HasSuffix(host, "]") {
         if schema == "https" {
@@ -1,12 +1,19 @@
 package main
 
 import (
+    "bufio"
     "context"
+    "io"
     "log"
     "net"
     "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
     "testing"
+    "time"
 
+    "github.com/miekg/dns"
     "github.com/stretchr/testify/require"
 )
 
@@ -22,10 +29,10 @@ func TestChinaIPFromDoH(t *testing.T) {
         dns:    &dnsOverHTTPS{provider: defaultTestDoHProvider},
     }
     host := "www.baidu.com"
-    err, answer, _ := local.dns.lookup(host)
+    err, records := local.dns.lookup(host, dns.TypeA)
     require.Nil(t, err)
-    require.NotNil(t, answer)
-    require.True(t, chinaIPDB.contains(answer))
+    require.NotEmpty(t, records)
+    require.True(t, chinaIPDB.contains(records[0].ip))
 }
 
 func TestPullLatestIPRange(t *testing.T) {
@@ -57,3 +64,369 @@ func TestPullLatestIPRange(t *testing.T) {
     cn = "106.85.37.170"
     require.True(t, local.chinaIPRangeDB.contains(net.ParseIP(cn)))
 }
+
+func TestServeProxyGroups(t *testing.T) {
+    hk, _ := url.Parse("https://hk.example.com")
+    jp, _ := url.Parse("https://jp.example.com")
+    hkClient, _ := newRemoteProxyClient("hk", hk, "secret", remoteProxyTransportHTTP1, 0, connTimeouts{})
+    jpClient, _ := newRemoteProxyClient("jp", jp, "secret", remoteProxyTransportHTTP1, 0, connTimeouts{})
+    manual := newRemoteProxySelect("manual", []tunnelDialer{hkClient, jpClient})
+
+    local := &localProxyServer{selectGroups: map[string]*remoteProxySelect{"manual": manual}}
+    server := httptest.NewServer(local)
+    defer server.Close()
+
+    res, err := http.Get(server.URL + "/proxy-groups")
+    require.Nil(t, err)
+    body, _ := io.ReadAll(res.Body)
+    res.Body.Close()
+    require.JSONEq(t, `{"manual":{"now":"hk","all":["hk","jp"]}}`, string(body))
+
+    req, _ := http.NewRequest(http.MethodPut, server.URL+"/proxy-groups/manual", strings.NewReader(`{"name":"jp"}`))
+    res, err = http.DefaultClient.Do(req)
+    require.Nil(t, err)
+    res.Body.Close()
+    require.Equal(t, http.StatusNoContent, res.StatusCode)
+    require.Equal(t, "jp", manual.now())
+
+    req, _ = http.NewRequest(http.MethodPut, server.URL+"/proxy-groups/manual", strings.NewReader(`{"name":"sg"}`))
+    res, err = http.DefaultClient.Do(req)
+    require.Nil(t, err)
+    res.Body.Close()
+    require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// stubTunnelDialer connects every tunnel to addr, whatever the target.
+type stubTunnelDialer struct {
+    addr  string
+    dials int
+}
+
+func (d *stubTunnelDialer) dialTunnel(_ string) (net.Conn, error) {
+    d.dials++
+    return net.Dial("tcp", d.addr)
+}
+
+func (d *stubTunnelDialer) name() string {
+    return "stub"
+}
+
+func TestConnectFallbackToRemote(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+
+    host, port, _ := net.SplitHostPort(newDeadAddr(t))
+    local := &localProxyServer{
+        remoteProxy:      remote,
+        fallbackToRemote: true,
+        routes:           newRouteMemory(16, time.Minute),
+    }
+
+    conn, err := local.connectWithFallback("example.cn", []net.IP{net.ParseIP(host)}, nil, port, routeDirect)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+    require.Equal(t, routeRemote, local.routes.get("example.cn"))
+
+    conn, err = local.connectWithFallback("example.cn", []net.IP{net.ParseIP(host)}, nil, port, routeDirect)
+    require.Nil(t, err)
+    conn.Close()
+    require.Equal(t, 2, remote.dials)
+
+    local.fallbackToRemote = false
+    local.routes.forget("example.cn")
+    _, err = local.connectWithFallback("example.cn", []net.IP{net.ParseIP(host)}, nil, port, routeDirect)
+    require.NotNil(t, err)
+    require.Equal(t, 2, remote.dials)
+}
+
+func TestRaceDirectAndRemote(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+
+    local := &localProxyServer{
+        remoteProxy: remote,
+        raceDelay:   time.Second,
+        routes:      newRouteMemory(16, time.Minute),
+    }
+
+    host, port, _ := net.SplitHostPort(echo.Addr().String())
+    conn, err := local.race("example.com", []net.IP{net.ParseIP(host)}, nil, port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 0, remote.dials)
+    require.Equal(t, routeDirect, local.routes.get("example.com"))
+
+    // the remote proxy starts at once when the direct connection fails
+    host, port, _ = net.SplitHostPort(newDeadAddr(t))
+    start := time.Now()
+    conn, err = local.race("example.org", []net.IP{net.ParseIP(host)}, nil, port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Less(t, time.Since(start), time.Second)
+    require.Equal(t, 1, remote.dials)
+    require.Equal(t, routeRemote, local.routes.get("example.org"))
+}
+
+func TestRaceRemembersDirectOnlyAfterData(t *testing.T) {
+    // like SNI blocking: the connect succeeds, the handshake is reset
+    reset, err := net.Listen("tcp", "127.0.0.1:0")
+    require.Nil(t, err)
+    defer reset.Close()
+    go func() {
+        for {
+            conn, err := reset.Accept()
+            if err != nil {
+                return
+            }
+            conn.Read(make([]byte, 1))
+            conn.(*net.TCPConn).SetLinger(0)
+            conn.Close()
+        }
+    }()
+    echo := newEchoServer(t)
+    defer echo.Close()
+
+    local := &localProxyServer{
+        remoteProxy: &stubTunnelDialer{addr: echo.Addr().String()},
+        raceDelay:   time.Second,
+        routes:      newRouteMemory(16, time.Minute),
+    }
+
+    host, port, _ := net.SplitHostPort(reset.Addr().String())
+    conn, err := local.race("blocked.example.com", []net.IP{net.ParseIP(host)}, nil, port)
+    require.Nil(t, err)
+    defer conn.Close()
+    require.Equal(t, route(0), local.routes.get("blocked.example.com"))
+
+    conn.Write([]byte("hello"))
+    _, err = conn.Read(make([]byte, 5))
+    require.NotNil(t, err)
+    require.Equal(t, routeRemote, local.routes.get("blocked.example.com"))
+}
+
+func TestConnectByRule(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+    dialers := map[string]tunnelDialer{"stub": remote}
+
+    var rules ruleSet
+    for _, line := range []string{"DOMAIN,blocked.example.com,REJECT", "DOMAIN,tunnel.example.com,REMOTE:stub"} {
+        r, err := parseRule(line, dialers, remote, nil)
+        require.Nil(t, err)
+        rules = append(rules, r)
+    }
+    local := &localProxyServer{rules: rules}
+
+    conn, err := local.connect("127.0.0.1:1234", "tunnel.example.com", "443")
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+
+    server := httptest.NewServer(local)
+    defer server.Close()
+    proxyURL, _ := url.Parse(server.URL)
+    client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+    res, err := client.Get("http://blocked.example.com/")
+    require.Nil(t, err)
+    res.Body.Close()
+    require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestBlockListAndStats(t *testing.T) {
+    local := &localProxyServer{blockList: newTestBlockList(t)}
+    server := httptest.NewServer(local)
+    defer server.Close()
+
+    proxyURL, _ := url.Parse(server.URL)
+    client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+    res, err := client.Get("http://ads.example.com/banner.js")
+    require.Nil(t, err)
+    res.Body.Close()
+    require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+    res, err = http.Get(server.URL + "/stats")
+    require.Nil(t, err)
+    body, _ := io.ReadAll(res.Body)
+    res.Body.Close()
+    require.JSONEq(t, `{"blocked":{"proxy":1,"dns":0,"domains":{"ads.example.com":1}}}`, string(body))
+}
+
+func TestConnectToIPRoutesBySniffedHost(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+    r, err := parseRule("DOMAIN,www.example.com,REMOTE", nil, remote, nil)
+    require.Nil(t, err)
+
+    local := &localProxyServer{rules: ruleSet{r}}
+    server := httptest.NewServer(local)
+    defer server.Close()
+
+    conn, err := net.Dial("tcp", server.Listener.Addr().String())
+    require.Nil(t, err)
+    defer conn.Close()
+
+    // the request is pipelined right behind CONNECT
+    target := newDeadAddr(t)
+    request := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+    _, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n" + request))
+    require.Nil(t, err)
+
+    reader := bufio.NewReader(conn)
+    res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+    require.Nil(t, err)
+    require.Equal(t, http.StatusOK, res.StatusCode)
+
+    echoed := make([]byte, len(request))
+    _, err = io.ReadFull(reader, echoed)
+    require.Nil(t, err)
+    require.Equal(t, request, string(echoed))
+    require.Equal(t, 1, remote.dials)
+}
+
+func TestConnectToIPDialsTheIPDirectly(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    resolver := &countingResolver{ip: net.ParseIP("192.0.2.1")}
+    local := &localProxyServer{
+        dns:           resolver,
+        directDomains: domainSet{"www.example.cn": {}},
+    }
+    server := httptest.NewServer(local)
+    defer server.Close()
+
+    conn, err := net.Dial("tcp", server.Listener.Addr().String())
+    require.Nil(t, err)
+    defer conn.Close()
+
+    // the sniffed name routes directly, but to the IP of the CONNECT rather
+    // than to what the name resolves to
+    target := echo.Addr().String()
+    request := "GET / HTTP/1.1\r\nHost: www.example.cn\r\n\r\n"
+    _, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n" + request))
+    require.Nil(t, err)
+
+    reader := bufio.NewReader(conn)
+    res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+    require.Nil(t, err)
+    require.Equal(t, http.StatusOK, res.StatusCode)
+
+    echoed := make([]byte, len(request))
+    _, err = io.ReadFull(reader, echoed)
+    require.Nil(t, err)
+    require.Equal(t, request, string(echoed))
+    require.Empty(t, resolver.lookups)
+}
+
+// countingResolver records the hosts looked up and answers with ip.
+type countingResolver struct {
+    ip      net.IP
+    lookups []string
+}
+
+func (r *countingResolver) lookup(host string, qtype uint16) (err error, records []dnsRecord) {
+    r.lookups = append(r.lookups, host)
+    if isIPv4(r.ip) == (qtype == dns.TypeA) {
+        records = append(records, dnsRecord{ip: r.ip, expiredAt: time.Now().Add(time.Minute)})
+    }
+    return nil, records
+}
+
+func (r *countingResolver) name() string {
+    return "countingResolver"
+}
+
+func TestResolveOnRemote(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+    host, port, _ := net.SplitHostPort(echo.Addr().String())
+    resolver := &countingResolver{ip: net.ParseIP(host)}
+    r, err := parseRule("IP-CIDR,127.0.0.0/8,DIRECT", nil, remote, nil)
+    require.Nil(t, err)
+
+    local := &localProxyServer{
+        remoteProxy:     remote,
+        dns:             resolver,
+        rules:           ruleSet{r},
+        ipPreference:    ipV4Only,
+        resolveOnRemote: true,
+    }
+
+    conn, err := local.connect("127.0.0.1:1234", "www.example.com", port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+    require.Empty(t, resolver.lookups)
+
+    // known China domains are still resolved locally and connected directly
+    conn, err = local.connect("127.0.0.1:1234", "www.example.cn", port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+    require.Equal(t, []string{"www.example.cn"}, resolver.lookups)
+}
+
+func TestConnectMapsFakeIPToDomain(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+    r, err := parseRule("DOMAIN,www.example.com,REMOTE", nil, remote, nil)
+    require.Nil(t, err)
+    pool, err := newFakeIPPool("198.18.0.0/15", "")
+    require.Nil(t, err)
+
+    local := &localProxyServer{rules: ruleSet{r}, fakeIPs: pool}
+    ip := pool.lookupIP("www.example.com")
+    conn, err := local.connect("127.0.0.1:1234", ip.String(), "443")
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+
+    _, err = local.connect("127.0.0.1:1234", "198.18.0.100", "443")
+    require.NotNil(t, err)
+}
+
+func TestConnectPassesFakeIPDomainsToRemote(t *testing.T) {
+    echo := newEchoServer(t)
+    defer echo.Close()
+    remote := &stubTunnelDialer{addr: echo.Addr().String()}
+    host, port, _ := net.SplitHostPort(echo.Addr().String())
+    resolver := &countingResolver{ip: net.ParseIP(host)}
+    pool, err := newFakeIPPool("198.18.0.0/15", "")
+    require.Nil(t, err)
+
+    local := &localProxyServer{
+        remoteProxy:  remote,
+        dns:          resolver,
+        fakeIPs:      pool,
+        ipPreference: ipV4Only,
+    }
+
+    // without --resolve-on-remote, foreign domains are not resolved locally
+    conn, err := local.connect("127.0.0.1:1234", pool.lookupIP("www.example.com").String(), port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+    require.Empty(t, resolver.lookups)
+
+    // known China domains are still resolved locally and connected directly
+    conn, err = local.connect("127.0.0.1:1234", pool.lookupIP("www.example.cn").String(), port)
+    require.Nil(t, err)
+    requireEcho(t, conn)
+    conn.Close()
+    require.Equal(t, 1, remote.dials)
+    require.Equal(t, []string{"www.example.cn"}, resolver.lookups)
+}
@@ -5,156 +5,710 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 
 	"github.com/robfig/cron/v3"
 	"github.com/urfave/cli/v2"
 )
 
 type LocalProxyFlags struct {
+	configFile                    string
+	reloadCheckIntervalInSeconds  int
+	drainTimeoutInSeconds         int
+	dialTimeoutInSeconds          int
+	tlsHandshakeTimeoutInSeconds  int
+	idleTimeoutInSeconds          int
+	tcpKeepAliveInSeconds         int
 	listenAddr                    string
-	remoteProxyAddr               string
+	remoteProxyAddrs              cli.StringSlice
 	dnsOverHttpsProvider          string
+	dnsBackends                   cli.StringSlice
 	staticDnsTTLInSeconds         int
 	forceForwardToRemoteProxy     bool
 	secretKey                     string
 	pullLatestIPDBDurationInHours int
+	socks5ListenAddr              string
+	socks5Username                string
+	socks5Password                string
+	transparentListenAddr         string
+	directDomainsFile             string
+	remoteDomainsFile             string
+	usersFile                     string
+	allowClients                  cli.StringSlice
+	denyClients                   cli.StringSlice
+	dnsListenAddr                 string
+	remoteProxyTransport          string
+	remoteProxyPoolSize           int
+	healthCheckTarget             string
+	healthCheckIntervalInSeconds  int
+	proxyGroups                   cli.StringSlice
+	remoteProxyGroup              string
+	fallbackToRemote              bool
+	fallbackToDirect              bool
+	directDialTimeoutInSeconds    int
+	routeMemoryInMinutes          int
+	raceDirectAndRemote           bool
+	raceDelayInMilliseconds       int
+	ipPreference                  string
+	rulesFile                     string
+	ruleProviders                 cli.StringSlice
+	blockLists                    cli.StringSlice
+	resolveOnRemote               bool
+	fakeIPRange                   string
+	fakeIPFile                    string
+	rules                         []string
+}
+
+type NftablesFlags struct {
+	transparentListenAddr string
 }
 
 type RemoteProxyFlags struct {
-	domain                 string
-	whitelist              cli.StringSlice
-	certCacheDir           string
-	staticReversedUrl      string
-	enableWebsiteRatelimit bool
-	secretKey              string
+	configFile                   string
+	domain                       string
+	whitelist                    cli.StringSlice
+	certCacheDir                 string
+	staticReversedUrl            string
+	enableWebsiteRatelimit       bool
+	secretKey                    string
+	drainTimeoutInSeconds        int
+	dialTimeoutInSeconds         int
+	tlsHandshakeTimeoutInSeconds int
+	idleTimeoutInSeconds         int
+	tcpKeepAliveInSeconds        int
 }
 
 var (
 	localProxyFlags  LocalProxyFlags
 	remoteProxyFlags RemoteProxyFlags
+	nftablesFlags    NftablesFlags
 )
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	log.SetOutput(os.Stdout)
 
-	localProxyCmd := &cli.Command{
+	localProxyCmd := newLocalProxyCmd(&localProxyFlags, localProxyServerCmdAction)
+
+	remoteProxyCmd := &cli.Command{
+		Name:   "start-remote-proxy-server",
+		Usage:  "Start remote proxy server",
+		Before: loadConfigBefore(nil),
+		Flags: []cli.Flag{
+			newConfigFlag(&remoteProxyFlags.configFile),
+			&cli.StringFlag{
+				Name:        "domain",
+				Value:       "yourdomain.com",
+				Usage:       "domain to access to certificates from Let's Encrypt",
+				Destination: &remoteProxyFlags.domain,
+			},
+			&cli.StringSliceFlag{
+				Name:        "whitelist",
+				Value:       nil,
+				Usage:       "whitelist to allowed Let's Encrypt to verify",
+				Destination: &remoteProxyFlags.whitelist,
+			},
+			&cli.StringFlag{
+				Name:        "cert-cache-dir",
+				Value:       "certs",
+				Usage:       "directory to stores and retrieves previously-obtained certificates",
+				Destination: &remoteProxyFlags.certCacheDir,
+			},
+			&cli.StringFlag{
+				Name:        "static-reversed-url",
+				Value:       "https://mirrors.teamcloud.am",
+				Usage:       "static reversed url",
+				Destination: &remoteProxyFlags.staticReversedUrl,
+			},
+			&cli.BoolFlag{
+				Name:        "enable-website-ratelimit",
+				Value:       true,
+				Usage:       "enable rate limiting for website",
+				Destination: &remoteProxyFlags.enableWebsiteRatelimit,
+			},
+			&cli.StringFlag{
+				Name:        "secret-key",
+				Value:       "<your secret key>",
+				Usage:       "secret key",
+				Destination: &remoteProxyFlags.secretKey,
+			},
+			&cli.IntFlag{
+				Name:        "drain-timeout-seconds",
+				Value:       30,
+				Usage:       "timeout(seconds) to wait for tunnels in flight to finish on SIGINT or SIGTERM before closing them",
+				Destination: &remoteProxyFlags.drainTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "dial-timeout-seconds",
+				Value:       10,
+				Usage:       "timeout(seconds) of opening a TCP connection, 0 means the system default",
+				Destination: &remoteProxyFlags.dialTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "tls-handshake-timeout-seconds",
+				Value:       10,
+				Usage:       "timeout(seconds) of the TLS handshake of a client, disabled if 0",
+				Destination: &remoteProxyFlags.tlsHandshakeTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "idle-timeout-seconds",
+				Value:       300,
+				Usage:       "close a tunnel, or an upstream connection of plain HTTP requests, when no data has passed in either direction for this many seconds, also the time to wait for response headers, disabled if 0",
+				Destination: &remoteProxyFlags.idleTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "tcp-keepalive-seconds",
+				Value:       30,
+				Usage:       "interval(seconds) of TCP keepalive probes on opened connections, disabled if 0",
+				Destination: &remoteProxyFlags.tcpKeepAliveInSeconds,
+			},
+		},
+		Action: remoteProxyServerCmdAction,
+	}
+
+	nftablesCmd := &cli.Command{
+		Name:  "print-nftables-rules",
+		Usage: "Print nftables rules redirecting forwarded TCP traffic to the transparent proxy",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "transparent-listen-addr",
+				Value:       ":5687",
+				Usage:       "transparent proxy listen address",
+				Destination: &nftablesFlags.transparentListenAddr,
+			},
+		},
+		Action: nftablesCmdAction,
+	}
+
+	app := &cli.App{
+		Commands: []*cli.Command{
+			localProxyCmd,
+			remoteProxyCmd,
+			nftablesCmd,
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatalf("failed to run app: %s", err.Error())
+	}
+}
+
+// newLocalProxyCmd returns the start-local-proxy-server command with its
+// flags bound to flags, so that a reload can parse them again into a fresh
+// LocalProxyFlags.
+func newLocalProxyCmd(flags *LocalProxyFlags, action cli.ActionFunc) *cli.Command {
+	return &cli.Command{
 		Name:  "start-local-proxy-server",
 		Usage: "Start local proxy server",
+		Before: loadConfigBefore(map[string]*[]string{
+			"rules": &flags.rules,
+		}),
 		Flags: []cli.Flag{
+			newConfigFlag(&flags.configFile),
+			&cli.IntFlag{
+				Name:        "reload-check-interval-seconds",
+				Value:       5,
+				Usage:       "interval(seconds) of checking the config, rules, domains and users files for changes to reload, disabled if 0",
+				Destination: &flags.reloadCheckIntervalInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "drain-timeout-seconds",
+				Value:       30,
+				Usage:       "timeout(seconds) to wait for tunnels in flight to finish on SIGINT or SIGTERM before closing them",
+				Destination: &flags.drainTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "dial-timeout-seconds",
+				Value:       10,
+				Usage:       "timeout(seconds) of opening a TCP connection to a remote proxy, 0 means the system default",
+				Destination: &flags.dialTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "tls-handshake-timeout-seconds",
+				Value:       10,
+				Usage:       "timeout(seconds) of the TLS handshake with a remote proxy, disabled if 0",
+				Destination: &flags.tlsHandshakeTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "idle-timeout-seconds",
+				Value:       300,
+				Usage:       "close a tunnel, or an upstream connection of plain HTTP requests, when no data has passed in either direction for this many seconds, also the time to wait for response headers, disabled if 0",
+				Destination: &flags.idleTimeoutInSeconds,
+			},
+			&cli.IntFlag{
+				Name:        "tcp-keepalive-seconds",
+				Value:       30,
+				Usage:       "interval(seconds) of TCP keepalive probes on opened connections, disabled if 0",
+				Destination: &flags.tcpKeepAliveInSeconds,
+			},
 			&cli.StringFlag{
 				Name:        "listen-addr",
 				Value:       "127.0.0.1:5686",
 				Usage:       "listen address",
-				Destination: &localProxyFlags.listenAddr,
+				Destination: &flags.listenAddr,
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:        "remote-proxy-addr",
-				Value:       "https://yourdomain.com",
-				Usage:       "remote proxy address",
-				Destination: &localProxyFlags.remoteProxyAddr,
+				Value:       cli.NewStringSlice("https://yourdomain.com"),
+				Usage:       "remote proxy address as scheme://[secret@]host[:port][#name], repeat for failover in order",
+				Destination: &flags.remoteProxyAddrs,
+			},
+			&cli.StringFlag{
+				Name:        "health-check-target",
+				Value:       "www.google.com:443",
+				Usage:       "target tunneled through every remote proxy to check its health",
+				Destination: &flags.healthCheckTarget,
+			},
+			&cli.IntFlag{
+				Name:        "health-check-interval-seconds",
+				Value:       30,
+				Usage:       "interval(seconds) of remote proxy health checks, disabled if 0",
+				Destination: &flags.healthCheckIntervalInSeconds,
+			},
+			&cli.StringSliceFlag{
+				Name:        "proxy-group",
+				Value:       nil,
+				Usage:       "proxy group as name=type[/option]:member|..., type is url-test[/tolerance], load-balance[/round-robin|consistent-hash] or select",
+				Destination: &flags.proxyGroups,
+			},
+			&cli.StringFlag{
+				Name:        "remote-proxy-group",
+				Value:       defaultProxyGroup,
+				Usage:       "remote proxy or proxy group to forward to, failover over all remote proxies by default",
+				Destination: &flags.remoteProxyGroup,
+			},
+			&cli.StringFlag{
+				Name:        "remote-proxy-transport",
+				Value:       remoteProxyTransportHTTP1,
+				Usage:       "transport to remote proxy: http1 dials one connection per tunnel, http2 multiplexes tunnels over one connection",
+				Destination: &flags.remoteProxyTransport,
+			},
+			&cli.IntFlag{
+				Name:        "remote-proxy-pool-size",
+				Value:       0,
+				Usage:       "number of pre-warmed idle connections to remote proxy for the http1 transport, disabled if 0",
+				Destination: &flags.remoteProxyPoolSize,
 			},
 			&cli.StringFlag{
 				Name:        "dns-over-https-provider",
 				Value:       "https://doh.360.cn/dns-query",
 				Usage:       "DNS over HTTPS provider",
-				Destination: &localProxyFlags.dnsOverHttpsProvider,
+				Destination: &flags.dnsOverHttpsProvider,
+			},
+			&cli.StringSliceFlag{
+				Name:        "dns-backend",
+				Value:       cli.NewStringSlice(dnsBackendHosts, dnsBackendDoH, dnsBackendSystem),
+				Usage:       "DNS backend asked in the order given until one has an answer: hosts, system, doh for --dns-over-https-provider or doh:<url>, can be repeated",
+				Destination: &flags.dnsBackends,
 			},
 			&cli.IntFlag{
 				Name:        "static-dns-ttl-seconds",
 				Value:       86400,
 				Usage:       "static DNS TTL in seconds",
-				Destination: &localProxyFlags.staticDnsTTLInSeconds,
+				Destination: &flags.staticDnsTTLInSeconds,
 			},
 			&cli.BoolFlag{
 				Name:        "force-forward-to-remote-proxy",
 				Value:       false,
 				Usage:       "force forward all requests to remote proxy",
-				Destination: &localProxyFlags.forceForwardToRemoteProxy,
+				Destination: &flags.forceForwardToRemoteProxy,
+			},
+
+			&cli.BoolFlag{
+				Name:        "resolve-on-remote",
+				Value:       false,
+				Usage:       "send host names not known to be in China to remote proxy unresolved instead of resolving them locally",
+				Destination: &flags.resolveOnRemote,
+			},
+			&cli.BoolFlag{
+				Name:        "fallback-to-remote",
+				Value:       true,
+				Usage:       "retry through remote proxy when connecting directly fails",
+				Destination: &flags.fallbackToRemote,
+			},
+			&cli.BoolFlag{
+				Name:        "fallback-to-direct",
+				Value:       false,
+				Usage:       "retry directly when connecting through remote proxy fails",
+				Destination: &flags.fallbackToDirect,
+			},
+			&cli.IntFlag{
+				Name:        "direct-dial-timeout-seconds",
+				Value:       5,
+				Usage:       "timeout in seconds of connecting directly, 0 means the system default",
+				Destination: &flags.directDialTimeoutInSeconds,
+			},
+			&cli.BoolFlag{
+				Name:        "race-direct-and-remote",
+				Value:       false,
+				Usage:       "race a direct connection against the remote proxy for hosts outside the China IP ranges and domain lists",
+				Destination: &flags.raceDirectAndRemote,
+			},
+			&cli.IntFlag{
+				Name:        "race-delay-milliseconds",
+				Value:       300,
+				Usage:       "head start in milliseconds of the direct connection in a race",
+				Destination: &flags.raceDelayInMilliseconds,
+			},
+			&cli.StringFlag{
+				Name:        "ip-preference",
+				Value:       ipPreferV4,
+				Usage:       "address family order of direct connections: prefer-v4, prefer-v6 or v4-only",
+				Destination: &flags.ipPreference,
+			},
+			&cli.IntFlag{
+				Name:        "route-memory-minutes",
+				Value:       30,
+				Usage:       "how long in minutes to remember the fallback route that worked for a host",
+				Destination: &flags.routeMemoryInMinutes,
 			},
 
 			&cli.IntFlag{
 				Name:        "pull-latest-ipdb-interval-in-hours",
 				Value:       24,
 				Usage:       "internal(hours) of pulling the latest IP database",
-				Destination: &localProxyFlags.pullLatestIPDBDurationInHours,
+				Destination: &flags.pullLatestIPDBDurationInHours,
 			},
 
 			&cli.StringFlag{
 				Name:        "secret-key",
 				Value:       "<your secret key>",
 				Usage:       "secret key required by remote proxy",
-				Destination: &localProxyFlags.secretKey,
+				Destination: &flags.secretKey,
 			},
-		},
-		Action: localProxyServerCmdAction,
-	}
 
-	remoteProxyCmd := &cli.Command{
-		Name:  "start-remote-proxy-server",
-		Usage: "Start remote proxy server",
-		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:        "domain",
-				Value:       "yourdomain.com",
-				Usage:       "domain to access to certificates from Let's Encrypt",
-				Destination: &remoteProxyFlags.domain,
+				Name:        "socks5-listen-addr",
+				Value:       "",
+				Usage:       "SOCKS5 listen address, disabled if empty",
+				Destination: &flags.socks5ListenAddr,
+			},
+			&cli.StringFlag{
+				Name:        "socks5-username",
+				Value:       "",
+				Usage:       "username required from HTTP and SOCKS5 clients in addition to --users-file, authentication is disabled if both are empty",
+				Destination: &flags.socks5Username,
+			},
+			&cli.StringFlag{
+				Name:        "socks5-password",
+				Value:       "",
+				Usage:       "password of --socks5-username",
+				Destination: &flags.socks5Password,
+			},
+
+			&cli.StringFlag{
+				Name:        "transparent-listen-addr",
+				Value:       "",
+				Usage:       "transparent proxy listen address for REDIRECT'ed connections (Linux only), disabled if empty",
+				Destination: &flags.transparentListenAddr,
+			},
+
+			&cli.StringFlag{
+				Name:        "direct-domains-file",
+				Value:       "",
+				Usage:       "file of domains, one per line, always connected to directly",
+				Destination: &flags.directDomainsFile,
+			},
+			&cli.StringFlag{
+				Name:        "remote-domains-file",
+				Value:       "",
+				Usage:       "file of domains, one per line, always forwarded to remote proxy",
+				Destination: &flags.remoteDomainsFile,
+			},
+
+			&cli.StringFlag{
+				Name:        "rules-file",
+				Value:       "",
+				Usage:       "file of routing rules evaluated in order before the built-in routing",
+				Destination: &flags.rulesFile,
 			},
 			&cli.StringSliceFlag{
-				Name:        "whitelist",
-				Value:       nil,
-				Usage:       "whitelist to allowed Let's Encrypt to verify",
-				Destination: &remoteProxyFlags.whitelist,
+				Name:        "rule-provider",
+				Usage:       "domain or IP list for rules in the form name=format:location, format is gfwlist, dnsmasq, geosite or geoip, location is a file or URL, can be repeated",
+				Destination: &flags.ruleProviders,
+			},
+			&cli.StringSliceFlag{
+				Name:        "block-list",
+				Usage:       "hosts file or AdGuard filter list of ad and tracker domains to block, a file or URL, can be repeated",
+				Destination: &flags.blockLists,
 			},
 			&cli.StringFlag{
-				Name:        "cert-cache-dir",
-				Value:       "certs",
-				Usage:       "directory to stores and retrieves previously-obtained certificates",
-				Destination: &remoteProxyFlags.certCacheDir,
+				Name:        "users-file",
+				Value:       "",
+				Usage:       "file of username:password lines required from HTTP and SOCKS5 clients",
+				Destination: &flags.usersFile,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-client",
+				Value:       nil,
+				Usage:       "CIDR or IP allowed to use the local proxy, all clients are allowed if empty",
+				Destination: &flags.allowClients,
 			},
+			&cli.StringSliceFlag{
+				Name:        "deny-client",
+				Value:       nil,
+				Usage:       "CIDR or IP denied to use the local proxy, takes precedence over --allow-client",
+				Destination: &flags.denyClients,
+			},
+
 			&cli.StringFlag{
-				Name:        "static-reversed-url",
-				Value:       "https://mirrors.teamcloud.am",
-				Usage:       "static reversed url",
-				Destination: &remoteProxyFlags.staticReversedUrl,
+				Name:        "dns-listen-addr",
+				Value:       "",
+				Usage:       "DNS server listen address (UDP and TCP), disabled if empty",
+				Destination: &flags.dnsListenAddr,
 			},
-			&cli.BoolFlag{
-				Name:        "enable-website-ratelimit",
-				Value:       true,
-				Usage:       "enable rate limiting for website",
-				Destination: &remoteProxyFlags.enableWebsiteRatelimit,
+			&cli.StringFlag{
+				Name:        "fake-ip-range",
+				Value:       "",
+				Usage:       "IPv4 range such as 198.18.0.0/15 the DNS server hands fake addresses out of, domains connected to by them are routed as with --resolve-on-remote, disabled if empty",
+				Destination: &flags.fakeIPRange,
 			},
 			&cli.StringFlag{
-				Name:        "secret-key",
-				Value:       "<your secret key>",
-				Usage:       "secret key",
-				Destination: &remoteProxyFlags.secretKey,
+				Name:        "fake-ip-file",
+				Value:       "",
+				Usage:       "file to persist the fake IP to domain mapping in, not persisted if empty",
+				Destination: &flags.fakeIPFile,
 			},
 		},
-		Action: remoteProxyServerCmdAction,
+		Action: action,
 	}
+}
 
-	app := &cli.App{
-		Commands: []*cli.Command{
-			localProxyCmd,
-			remoteProxyCmd,
+// newLocalProxyServer builds a local proxy from flags. The IP range
+// database, the route memory, the fake IPs and the tunnels in flight are
+// taken over from prev when reloading, so that they survive the reload.
+func newLocalProxyServer(flags *LocalProxyFlags, prev *localProxyServer) (_ *localProxyServer, err error) {
+	chinaIPRangeDB := newChinaIPRangeDB()
+	routes := newRouteMemory(4096, time.Duration(flags.routeMemoryInMinutes)*time.Minute)
+	var fakeIPs *fakeIPPool
+	idleTimeout := time.Duration(flags.idleTimeoutInSeconds) * time.Second
+	tunnels := newTunnelTracker(idleTimeout)
+	if prev != nil {
+		chinaIPRangeDB, routes, fakeIPs, tunnels = prev.chinaIPRangeDB, prev.routes, prev.fakeIPs, prev.tunnels
+	} else if flags.fakeIPRange != "" {
+		if fakeIPs, err = newFakeIPPool(flags.fakeIPRange, flags.fakeIPFile); err != nil {
+			return nil, err
+		}
+		if err = fakeIPs.load(); err != nil {
+			return nil, fmt.Errorf("load fake IPs from %s error: %v", flags.fakeIPFile, err)
+		}
+	}
+
+	staticTTL := time.Duration(flags.staticDnsTTLInSeconds) * time.Second
+	backends, doh, err := parseDNSBackends(flags.dnsBackends.Value(), flags.dnsOverHttpsProvider, staticTTL)
+	if err != nil {
+		return nil, err
+	}
+	if doh == nil {
+		// the DNS server still forwards the queries other than A and AAAA
+		doh = &dnsOverHTTPS{provider: flags.dnsOverHttpsProvider, staticTTL: staticTTL}
+	}
+	dns := newCachedDNS(backends...)
+
+	ipPreference, err := parseIPPreference(flags.ipPreference)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := newConnTimeouts(flags.dialTimeoutInSeconds, flags.tlsHandshakeTimeoutInSeconds, flags.idleTimeoutInSeconds, flags.tcpKeepAliveInSeconds)
+	timeouts.counts = tunnels.timeoutCounts()
+	var remotes []*remoteProxyClient
+	defer func() {
+		if err != nil {
+			closeRemoteProxyClients(remotes)
+		}
+	}()
+	labels := make(map[string]bool)
+	for _, raw := range flags.remoteProxyAddrs.Value() {
+		u, label, secret, err := parseRemoteProxyAddr(raw, flags.secretKey)
+		if err != nil {
+			return nil, errors.New("parse remote proxy address error: " + err.Error())
+		}
+		if labels[label] {
+			return nil, fmt.Errorf("duplicate remote proxy name %q", label)
+		}
+		labels[label] = true
+
+		remote, err := newRemoteProxyClient(label, u, secret, flags.remoteProxyTransport, flags.remoteProxyPoolSize, timeouts)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("at least one remote proxy address is required")
+	}
+
+	dialers := make(map[string]tunnelDialer)
+	for _, remote := range remotes {
+		dialers[remote.name()] = remote
+	}
+	if _, ok := dialers[defaultProxyGroup]; !ok {
+		dialers[defaultProxyGroup] = &remoteProxyFailover{label: defaultProxyGroup, remotes: remotes}
+	}
+	selectGroups := make(map[string]*remoteProxySelect)
+	for _, spec := range flags.proxyGroups.Value() {
+		group, err := parseProxyGroup(spec, dialers)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dialers[group.name()]; ok {
+			return nil, fmt.Errorf("duplicate proxy group name %q", group.name())
+		}
+		dialers[group.name()] = group
+		if s, ok := group.(*remoteProxySelect); ok {
+			selectGroups[s.name()] = s
+		}
+	}
+	remoteProxy, ok := dialers[flags.remoteProxyGroup]
+	if !ok {
+		return nil, fmt.Errorf("unknown remote proxy group %q", flags.remoteProxyGroup)
+	}
+
+	localProxy := &localProxyServer{
+		remoteProxy:               remoteProxy,
+		selectGroups:              selectGroups,
+		chinaIPRangeDB:            chinaIPRangeDB,
+		forceForwardToRemoteProxy: flags.forceForwardToRemoteProxy,
+		dns:                       dns,
+		fallbackToRemote:          flags.fallbackToRemote,
+		fallbackToDirect:          flags.fallbackToDirect,
+		directDialTimeout:         time.Duration(flags.directDialTimeoutInSeconds) * time.Second,
+		raceDirectAndRemote:       flags.raceDirectAndRemote,
+		raceDelay:                 time.Duration(flags.raceDelayInMilliseconds) * time.Millisecond,
+		ipPreference:              ipPreference,
+		resolveOnRemote:           flags.resolveOnRemote,
+		routes:                    routes,
+		fakeIPs:                   fakeIPs,
+		remotes:                   remotes,
+		dnsUpstream:               doh,
+		tunnels:                   tunnels,
+		timeouts:                  timeouts,
+	}
+	localProxy.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+				return localProxy.forwardToRemoteProxy(addr)
+			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatalf("failed to run app: %s", err.Error())
+	if flags.directDomainsFile != "" {
+		if localProxy.directDomains, err = loadDomainSet(flags.directDomainsFile); err != nil {
+			return nil, fmt.Errorf("load direct domains from %s error: %v", flags.directDomainsFile, err)
+		}
+	}
+	if flags.remoteDomainsFile != "" {
+		if localProxy.remoteDomains, err = loadDomainSet(flags.remoteDomainsFile); err != nil {
+			return nil, fmt.Errorf("load remote domains from %s error: %v", flags.remoteDomainsFile, err)
+		}
+	}
+	sources := &ruleSources{
+		geoIP: map[string]*iPRangeDB{
+			"CN":  localProxy.chinaIPRangeDB,
+			"LAN": privateIPRange,
+		},
+	}
+	for _, spec := range flags.ruleProviders.Value() {
+		provider, err := parseRuleProvider(spec, localProxy.client)
+		if err != nil {
+			return nil, err
+		}
+		if sources.namedProvider(provider.name) != nil {
+			return nil, fmt.Errorf("duplicate rule provider name %q", provider.name)
+		}
+		if !isListURL(provider.location) {
+			if err := provider.update(context.Background()); err != nil {
+				return nil, fmt.Errorf("load rule provider %s from %s error: %v", provider.name, provider.location, err)
+			}
+		} else {
+			if prev != nil {
+				for _, prevProvider := range prev.ruleProviders {
+					if prevProvider.name == provider.name {
+						provider.takeOver(prevProvider)
+					}
+				}
+			}
+			if !provider.loaded() {
+				localProxy.pendingLists = append(localProxy.pendingLists, pendingList{
+					name:   fmt.Sprintf("rule provider %s from %s", provider.name, provider.location),
+					update: provider.update,
+				})
+			}
+		}
+		sources.providers = append(sources.providers, provider)
+	}
+	localProxy.ruleProviders = sources.providers
+	if flags.rulesFile != "" {
+		if localProxy.rules, err = loadRules(flags.rulesFile, dialers, remoteProxy, sources); err != nil {
+			return nil, fmt.Errorf("load rules from %s error: %v", flags.rulesFile, err)
+		}
+	}
+	for i, line := range flags.rules {
+		r, err := parseRule(line, dialers, remoteProxy, sources)
+		if err != nil {
+			return nil, fmt.Errorf("config rules[%d] %q: %v", i, line, err)
+		}
+		localProxy.rules = append(localProxy.rules, r)
+	}
+	if len(flags.blockLists.Value()) > 0 {
+		localProxy.blockList = newBlockList(flags.blockLists.Value(), localProxy.client)
+		if !localProxy.blockList.fromURL() {
+			if err := localProxy.blockList.update(context.Background()); err != nil {
+				return nil, err
+			}
+		} else {
+			if prev != nil && prev.blockList != nil {
+				localProxy.blockList.takeOver(prev.blockList)
+			}
+			if !localProxy.blockList.loaded() {
+				localProxy.pendingLists = append(localProxy.pendingLists, pendingList{
+					name:   "block list",
+					update: localProxy.blockList.update,
+				})
+			}
+		}
+	}
+	localProxy.pac = newPACFile(localProxy)
+
+	if flags.usersFile != "" {
+		if localProxy.users, err = loadUsers(flags.usersFile); err != nil {
+			return nil, fmt.Errorf("load users from %s error: %v", flags.usersFile, err)
+		}
+	}
+	if flags.socks5Username != "" {
+		if localProxy.users == nil {
+			localProxy.users = make(userDB)
+		}
+		localProxy.users[flags.socks5Username] = flags.socks5Password
+	}
+
+	if localProxy.accessList, err = newAccessList(flags.allowClients.Value(), flags.denyClients.Value()); err != nil {
+		return nil, fmt.Errorf("parse client access list error: %v", err)
+	}
+
+	if flags.healthCheckIntervalInSeconds > 0 {
+		localProxy.healthChecker = &remoteProxyHealthChecker{
+			remotes:  remotes,
+			target:   flags.healthCheckTarget,
+			interval: time.Duration(flags.healthCheckIntervalInSeconds) * time.Second,
+		}
 	}
+	tunnels.setIdleTimeout(idleTimeout)
+	return localProxy, nil
 }
 
 func localProxyServerCmdAction(_ *cli.Context) error {
@@ -165,41 +719,66 @@ func localProxyServerCmdAction(_ *cli.Context) error {
 		return errors.New("listen on local proxy address error: " + err.Error())
 	}
 
-	u, err := url.Parse(localProxyFlags.remoteProxyAddr)
+	localProxy, err := newLocalProxyServer(&localProxyFlags, nil)
 	if err != nil {
-		return errors.New("parse remote proxy address error: " + err.Error())
+		return err
+	}
+	proxy := &reloadableLocalProxy{}
+	proxy.Store(localProxy)
+
+	proxy.load = func(prev *localProxyServer) (*localProxyServer, error) {
+		flags, err := parseLocalProxyFlags()
+		if err != nil {
+			return nil, err
+		}
+		warnRestartRequired(&localProxyFlags, flags)
+		next, err := newLocalProxyServer(flags, prev)
+		if err != nil {
+			return nil, err
+		}
+		reloadedFlags.Store(flags)
+		return next, nil
 	}
+	reloadedFlags.Store(&localProxyFlags)
+	localProxy.start()
 
-	h := make(http.Header)
-	h.Set(headerSecret, localProxyFlags.secretKey)
+	socks5 := &socks5Server{proxy: proxy}
+	listener = newMixedListener(listener, proxy, &socks4Server{proxy: proxy}, socks5)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: func(request *http.Request) (i *url.URL, e error) {
-				request.Header.Set(headerSecret, localProxyFlags.secretKey)
-				return u, nil
-			},
-			TLSClientConfig:    &tls.Config{InsecureSkipVerify: false},
-			ProxyConnectHeader: h,
-		},
+	var extraListeners []net.Listener
+	if localProxyFlags.socks5ListenAddr != "" {
+		socks5Listener, err := net.Listen("tcp", localProxyFlags.socks5ListenAddr)
+		if err != nil {
+			return errors.New("listen on SOCKS5 address error: " + err.Error())
+		}
+		extraListeners = append(extraListeners, socks5Listener)
+		go func() {
+			if err := socks5.serve(newAccessListener(socks5Listener, proxy)); err != nil {
+				log.Printf("SOCKS5 server stopped: %s", err)
+			}
+		}()
 	}
 
-	dns := newCachedDNS(
-		&dnsOverHostsFile{},
-		&dnsOverHTTPS{
-			provider:  localProxyFlags.dnsOverHttpsProvider,
-			staticTTL: time.Duration(localProxyFlags.staticDnsTTLInSeconds) * time.Second,
-		},
-		&dnsOverUDP{},
-	)
+	if localProxyFlags.transparentListenAddr != "" {
+		transparentListener, err := net.Listen("tcp", localProxyFlags.transparentListenAddr)
+		if err != nil {
+			return errors.New("listen on transparent proxy address error: " + err.Error())
+		}
+		extraListeners = append(extraListeners, transparentListener)
+		transparent := &transparentServer{proxy: proxy}
+		go func() {
+			if err := transparent.serve(newAccessListener(transparentListener, proxy)); err != nil {
+				log.Printf("transparent proxy server stopped: %s", err)
+			}
+		}()
+	}
 
-	localProxy := &localProxyServer{
-		remoteProxyAddr:           u,
-		secretKey:                 localProxyFlags.secretKey,
-		chinaIPRangeDB:            newChinaIPRangeDB(),
-		forceForwardToRemoteProxy: localProxyFlags.forceForwardToRemoteProxy,
-		client:                    client,
-		dns:                       dns,
+	if localProxyFlags.dnsListenAddr != "" {
+		go func() {
+			if err := listenAndServeDNS(localProxyFlags.dnsListenAddr, proxy); err != nil {
+				log.Printf("DNS server stopped: %s", err)
+			}
+		}()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -212,36 +791,173 @@ func localProxyServerCmdAction(_ *cli.Context) error {
 
 	s := cron.New()
 	s.AddFunc(fmt.Sprintf("@every %dh", localProxyFlags.pullLatestIPDBDurationInHours), func() {
+		localProxy := proxy.current()
 		log.Printf("start pulling the latest IP database at %s", time.Now())
 		if err := localProxy.pullLatestIPRange(ctx); err != nil {
 			log.Printf("failed to pull the latest IP database: %s, time: %s", err, time.Now())
 		}
 		log.Printf("end pulling the latest IP database at %s", time.Now())
+
+		if localProxy.blockList != nil {
+			if err := localProxy.blockList.update(ctx); err != nil {
+				log.Printf("failed to update block list: %s", err)
+			}
+		}
+		for _, provider := range localProxy.ruleProviders {
+			if err := provider.update(ctx); err != nil {
+				log.Printf("failed to update rule provider %s: %s", provider.name, err)
+			}
+		}
 	})
+	if localProxy.fakeIPs != nil {
+		s.AddFunc("@every 1m", func() {
+			if err := localProxy.fakeIPs.save(); err != nil {
+				log.Printf("failed to save fake IPs: %s", err)
+			}
+		})
+	}
 	s.Start()
 
+	reload := func(reason string) {
+		log.Printf("reload configuration on %s", reason)
+		if err := proxy.reload(); err != nil {
+			log.Printf("failed to reload configuration, keep the current one: %s", err)
+			return
+		}
+		log.Printf("configuration reloaded")
+	}
+	if localProxyFlags.reloadCheckIntervalInSeconds > 0 {
+		interval := time.Duration(localProxyFlags.reloadCheckIntervalInSeconds) * time.Second
+		go watchFiles(ctx, interval, func() []string {
+			return reloadedFlags.Load().watchedFiles()
+		}, func() {
+			reload("file change")
+		})
+	}
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			reload("SIGHUP")
+		}
+	}()
+
+	server := &http.Server{Handler: proxy}
+	stopped := make(chan struct{})
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-sigs
+		defer close(stopped)
+		sig := <-sigs
 		unsetSysProxy()
-		os.Exit(0)
+
+		drainTimeout := time.Duration(reloadedFlags.Load().drainTimeoutInSeconds) * time.Second
+		log.Printf("received %s, stop accepting and drain tunnels for up to %s", sig, drainTimeout)
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer drainCancel()
+
+		// cancel the running cron job, e.g. a pull of the IP database,
+		// rather than wait for it to finish
+		cancel()
+		select {
+		case <-s.Stop().Done():
+		case <-drainCtx.Done():
+		}
+		for _, l := range extraListeners {
+			l.Close()
+		}
+		if err := server.Shutdown(drainCtx); err != nil {
+			log.Printf("failed to shut down HTTP server: %s", err)
+			server.Close()
+		}
+		localProxy := proxy.current()
+		if err := localProxy.tunnels.drain(drainCtx); err != nil {
+			log.Printf("closed the tunnels still in flight after %s", drainTimeout)
+		}
+		localProxy.stop()
+
+		if err := localProxy.fakeIPs.save(); err != nil {
+			log.Printf("failed to save fake IPs: %s", err)
+		}
 	}()
 
-	if err = http.Serve(listener, localProxy); err != nil {
+	if err = server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		return errors.New("start HTTP server error: " + err.Error())
 	}
+	<-stopped
+	log.Printf("local proxy server stopped")
 
 	return nil
 }
 
+// reloadedFlags holds the flags the current local proxy was built from.
+var reloadedFlags atomic.Pointer[LocalProxyFlags]
+
+// parseLocalProxyFlags parses the command line and the config file again
+// into a fresh LocalProxyFlags.
+func parseLocalProxyFlags() (*LocalProxyFlags, error) {
+	flags := &LocalProxyFlags{}
+	app := &cli.App{
+		Commands: []*cli.Command{
+			newLocalProxyCmd(flags, func(*cli.Context) error { return nil }),
+		},
+		Writer:    io.Discard,
+		ErrWriter: io.Discard,
+	}
+	if err := app.Run(os.Args); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// watchedFiles returns the files whose changes trigger a reload.
+func (flags *LocalProxyFlags) watchedFiles() []string {
+	var paths []string
+	for _, path := range []string{flags.configFile, flags.rulesFile, flags.directDomainsFile, flags.remoteDomainsFile, flags.usersFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// warnRestartRequired logs the changed options that a reload cannot apply,
+// such as the addresses already listened on.
+func warnRestartRequired(running, reloaded *LocalProxyFlags) {
+	for name, changed := range map[string]bool{
+		"listen-addr":                   running.listenAddr != reloaded.listenAddr,
+		"socks5-listen-addr":            running.socks5ListenAddr != reloaded.socks5ListenAddr,
+		"transparent-listen-addr":       running.transparentListenAddr != reloaded.transparentListenAddr,
+		"dns-listen-addr":               running.dnsListenAddr != reloaded.dnsListenAddr,
+		"fake-ip-range":                 running.fakeIPRange != reloaded.fakeIPRange,
+		"fake-ip-file":                  running.fakeIPFile != reloaded.fakeIPFile,
+		"route-memory-minutes":          running.routeMemoryInMinutes != reloaded.routeMemoryInMinutes,
+		"pull-latest-ip-db-duration":    running.pullLatestIPDBDurationInHours != reloaded.pullLatestIPDBDurationInHours,
+		"reload-check-interval-seconds": running.reloadCheckIntervalInSeconds != reloaded.reloadCheckIntervalInSeconds,
+	} {
+		if changed {
+			log.Printf("%s changed, restart to apply it", name)
+		}
+	}
+}
+
 func remoteProxyServerCmdAction(_ *cli.Context) error {
 	remoteProxy := &remoteProxyServer{
 		enableWebsiteRatelimit: remoteProxyFlags.enableWebsiteRatelimit,
 		secretKey:              remoteProxyFlags.secretKey,
 		staticReversedAddr:     remoteProxyFlags.staticReversedUrl,
+		tunnels:                newTunnelTracker(time.Duration(remoteProxyFlags.idleTimeoutInSeconds) * time.Second),
+		timeouts: newConnTimeouts(
+			remoteProxyFlags.dialTimeoutInSeconds,
+			remoteProxyFlags.tlsHandshakeTimeoutInSeconds,
+			remoteProxyFlags.idleTimeoutInSeconds,
+			remoteProxyFlags.tcpKeepAliveInSeconds,
+		),
 	}
+	remoteProxy.timeouts.counts = remoteProxy.tunnels.timeoutCounts()
 
 	if err := os.MkdirAll(remoteProxyFlags.certCacheDir, 0700); err != nil {
 		return fmt.Errorf("create cert cache dir %s error: %v", remoteProxyFlags.certCacheDir, err)
@@ -259,6 +975,8 @@ func remoteProxyServerCmdAction(_ *cli.Context) error {
 	tlsConfig := &tls.Config{
 		GetCertificate: m.GetCertificate,
 		NextProtos: []string{
+			http2.NextProtoTLS,
+			"http/1.1",
 			acme.ALPNProto,
 		},
 	}
@@ -266,9 +984,57 @@ func remoteProxyServerCmdAction(_ *cli.Context) error {
 	s := &http.Server{Addr: ":443", TLSConfig: tlsConfig, Handler: remoteProxy}
 	defer s.Close()
 
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s error: %v", s.Addr, err)
+	}
+	// only the handshake is bounded: pooled connections of local proxies
+	// may wait up to remoteProxyPoolMaxIdle for their CONNECT
+	listener = newTLSListener(listener, tlsConfig, time.Duration(remoteProxyFlags.tlsHandshakeTimeoutInSeconds)*time.Second, remoteProxy.tunnels.timeoutCounts())
+
+	stopped := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		defer close(stopped)
+		sig := <-sigs
+
+		drainTimeout := time.Duration(remoteProxyFlags.drainTimeoutInSeconds) * time.Second
+		log.Printf("received %s, stop accepting and drain tunnels for up to %s", sig, drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+
+		// Shutdown waits for requests and HTTP/2 streams, but not for the
+		// hijacked connections of HTTP/1 tunnels, which are tracked apart
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down HTTPS server: %s", err)
+			s.Close()
+		}
+		if err := remoteProxy.tunnels.drain(ctx); err != nil {
+			log.Printf("closed the tunnels still in flight after %s", drainTimeout)
+		}
+	}()
+
 	log.Println("Starting HTTPS server on :443")
-	if err := s.ListenAndServeTLS("", ""); err != nil {
+	if err := s.Serve(listener); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("start HTTPS server on :443 error: %v", err)
 	}
+	<-stopped
+	log.Printf("remote proxy server stopped")
+	return nil
+}
+
+func nftablesCmdAction(_ *cli.Context) error {
+	_, port, err := net.SplitHostPort(nftablesFlags.transparentListenAddr)
+	if err != nil {
+		return errors.New("parse transparent proxy address error: " + err.Error())
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("parse transparent proxy port %s error: %v", port, err)
+	}
+
+	fmt.Print(nftablesRules(p))
 	return nil
 }
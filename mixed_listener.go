@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const sniffTimeout = 10 * time.Second
+
+// mixedListener lets a single port serve HTTP, SOCKS4/4a and SOCKS5 clients.
+// It peeks the first byte of every accepted connection: SOCKS connections
+// are served right away, everything else is handed out by Accept so that an
+// http.Server can serve it. SOCKS clients denied by the access list are
+// closed without a reply, HTTP ones are left to the http.Server to answer
+// 403.
+type mixedListener struct {
+	net.Listener
+	proxy  localProxyProvider
+	socks4 *socks4Server
+	socks5 *socks5Server
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMixedListener(listener net.Listener, proxy localProxyProvider, socks4 *socks4Server, socks5 *socks5Server) *mixedListener {
+	m := &mixedListener{
+		Listener: listener,
+		proxy:    proxy,
+		socks4:   socks4,
+		socks5:   socks5,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go m.acceptLoop()
+	return m
+}
+
+func (m *mixedListener) acceptLoop() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go m.dispatch(conn)
+	}
+}
+
+func (m *mixedListener) dispatch(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	head, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	isSOCKS := head[0] == socks5Version || head[0] == socks4Version
+	if isSOCKS && !m.proxy.current().accessList.allowedAddr(conn.RemoteAddr().String()) {
+		log.Printf("deny client %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	c := &bufferedConn{Conn: conn, reader: reader}
+	switch {
+	case head[0] == socks5Version && m.socks5 != nil:
+		m.socks5.serveConn(c)
+	case head[0] == socks4Version && m.socks4 != nil:
+		m.socks4.serveConn(c)
+	case isSOCKS:
+		log.Printf("reject SOCKS%d client %s: protocol disabled", head[0], conn.RemoteAddr())
+		conn.Close()
+	default:
+		select {
+		case m.conns <- c:
+		case <-m.closed:
+			conn.Close()
+		}
+	}
+}
+
+func (m *mixedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *mixedListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	return m.Listener.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMixedListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	proxy := &localProxyServer{chinaIPRangeDB: newChinaIPRangeDB()}
+	mixed := newMixedListener(l, proxy, &socks4Server{proxy: proxy}, &socks5Server{proxy: proxy})
+	go http.Serve(mixed, proxy)
+	return mixed
+}
+
+func requireEcho(t *testing.T, conn io.ReadWriter) {
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestMixedListenerHTTPConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	mixed := newTestMixedListener(t)
+	defer mixed.Close()
+
+	conn, err := net.Dial("tcp", mixed.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	requireEcho(t, struct {
+		io.Reader
+		io.Writer
+	}{reader, conn})
+}
+
+func TestMixedListenerSocks4(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	mixed := newTestMixedListener(t)
+	defer mixed.Close()
+
+	conn, err := net.Dial("tcp", mixed.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port), 127, 0, 0, 1, 'u', 0})
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, byte(socks4RepGranted), buf[1])
+
+	requireEcho(t, conn)
+}
+
+func TestMixedListenerSocks5(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	mixed := newTestMixedListener(t)
+	defer mixed.Close()
+
+	conn, err := net.Dial("tcp", mixed.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf[:2])
+	require.Nil(t, err)
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, byte(socks5RepSucceeded), buf[1])
+
+	requireEcho(t, conn)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pacFile generates a proxy auto-config file from the same data the local
+// proxy routes with, so that clients send China and LAN traffic directly
+// without going through the proxy at all.
+type pacFile struct {
+	sync.RWMutex
+	proxy  *localProxyServer
+	script string
+}
+
+func newPACFile(proxy *localProxyServer) *pacFile {
+	p := &pacFile{proxy: proxy}
+	p.update()
+	return p
+}
+
+// update regenerates the script; it must be called whenever the IP range
+// database or the domain lists change. A reload builds a new pacFile.
+func (p *pacFile) update() {
+	// the rules and the block list cannot be expressed in the script, so
+	// while they are in use, as while everything is forwarded to the remote
+	// proxy, only LAN traffic is sent directly and the proxy decides on the
+	// rest
+	remoteDomains, directDomains := p.proxy.remoteDomains, p.proxy.directDomains
+	proxyAll := p.proxy.forceForwardToRemoteProxy || len(p.proxy.rules) > 0 || p.proxy.blockList != nil
+	if proxyAll {
+		remoteDomains, directDomains = nil, nil
+	}
+
+	var b strings.Builder
+
+	b.WriteString("var remoteDomains = ")
+	writePACDomains(&b, remoteDomains)
+	b.WriteString(";\nvar directDomains = ")
+	writePACDomains(&b, directDomains)
+	b.WriteString(";\nvar directRanges = [")
+
+	var ranges [][2]uint32
+	if !proxyAll {
+		ranges = append(ranges, ipv4Ranges(p.proxy.chinaIPRangeDB)...)
+	}
+	ranges = append(ranges, ipv4Ranges(privateIPRange)...)
+	for i, r := range mergeIPv4Ranges(ranges) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "[%d,%d]", r[0], r[1])
+	}
+	b.WriteString("];\n")
+	b.WriteString(pacFunctions)
+
+	p.Lock()
+	defer p.Unlock()
+	p.script = b.String()
+}
+
+func (p *pacFile) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.RLock()
+	script := p.script
+	p.RUnlock()
+
+	addr := pacProxyAddr(req)
+	// no DIRECT fallback, which would send blocked sites around the proxy
+	// whenever it is unreachable
+	proxy, _ := json.Marshal(fmt.Sprintf("PROXY %s; SOCKS5 %s", addr, addr))
+
+	rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(rw, "var proxy = %s;\n", proxy)
+	fmt.Fprint(rw, script)
+}
+
+// pacProxyAddr returns the address clients reach the proxy at: the host
+// name they fetched the PAC file from, e.g. wpad, with the port of the
+// listener that accepted the request. The Host header is chosen by the
+// client, so the local address is used instead unless it is a plain host
+// name or IP address.
+func pacProxyAddr(req *http.Request) string {
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		return req.Host
+	}
+	localHost, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return local.String()
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || !isPACHostName(host) {
+		host = localHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func isPACHostName(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func writePACDomains(b *strings.Builder, domains domainSet) {
+	sorted := make([]string, 0, len(domains))
+	for domain := range domains {
+		sorted = append(sorted, domain)
+	}
+	sort.Strings(sorted)
+
+	b.WriteByte('{')
+	for i, domain := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%q:1", domain)
+	}
+	b.WriteByte('}')
+}
+
+// ipv4Ranges returns the IPv4 ranges of db as inclusive integer intervals.
+// PAC's dnsResolve only returns IPv4 addresses, so IPv6 ranges are skipped.
+func ipv4Ranges(db *iPRangeDB) [][2]uint32 {
+	db.RLock()
+	defer db.RUnlock()
+
+	var ranges [][2]uint32
+	for _, r := range db.db {
+		if len(r.min) != net.IPv4len || len(r.max) != net.IPv4len {
+			continue
+		}
+		ranges = append(ranges, [2]uint32{binary.BigEndian.Uint32(r.min), binary.BigEndian.Uint32(r.max)})
+	}
+	return ranges
+}
+
+// mergeIPv4Ranges sorts ranges and merges overlapping or adjacent ones,
+// which roughly halves the size of the China IP database.
+func mergeIPv4Ranges(ranges [][2]uint32) [][2]uint32 {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+
+	var merged [][2]uint32
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && uint64(r[0]) <= uint64(merged[last][1])+1 {
+			if r[1] > merged[last][1] {
+				merged[last][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+const pacFunctions = `
+function matchDomain(host, domains) {
+    for (;;) {
+        if (domains.hasOwnProperty(host)) {
+            return true;
+        }
+        var i = host.indexOf(".");
+        if (i < 0) {
+            return false;
+        }
+        host = host.substring(i + 1);
+    }
+}
+
+function ipToInt(ip) {
+    var parts = ip.split(".");
+    return ((+parts[0]) * 16777216) + ((+parts[1]) * 65536) + ((+parts[2]) * 256) + (+parts[3]);
+}
+
+function inDirectRanges(ip) {
+    var n = ipToInt(ip);
+    var lo = 0, hi = directRanges.length - 1;
+    while (lo <= hi) {
+        var mid = (lo + hi) >> 1;
+        if (n < directRanges[mid][0]) {
+            hi = mid - 1;
+        } else if (n > directRanges[mid][1]) {
+            lo = mid + 1;
+        } else {
+            return true;
+        }
+    }
+    return false;
+}
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    if (isPlainHostName(host)) {
+        return "DIRECT";
+    }
+    if (matchDomain(host, remoteDomains)) {
+        return proxy;
+    }
+    if (matchDomain(host, directDomains)) {
+        return "DIRECT";
+    }
+    var ip = dnsResolve(host);
+    if (!ip || ip.indexOf(":") >= 0) {
+        return proxy;
+    }
+    return inDirectRanges(ip) ? "DIRECT" : proxy;
+}
+`
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeIPv4Ranges(t *testing.T) {
+	merged := mergeIPv4Ranges([][2]uint32{{10, 20}, {0, 5}, {6, 8}, {15, 30}, {40, 50}})
+	require.Equal(t, [][2]uint32{{0, 8}, {10, 30}, {40, 50}}, merged)
+}
+
+func TestServePACFile(t *testing.T) {
+	proxy := &localProxyServer{
+		chinaIPRangeDB: newChinaIPRangeDB(),
+		directDomains:  domainSet{"baidu.com": {}},
+		remoteDomains:  domainSet{"google.com": {}},
+	}
+	proxy.pac = newPACFile(proxy)
+
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/proxy.pac")
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-ns-proxy-autoconfig", res.Header.Get("Content-Type"))
+
+	body, _ := io.ReadAll(res.Body)
+	script := string(body)
+	host := strings.TrimPrefix(server.URL, "http://")
+	require.True(t, strings.Contains(script, `var proxy = "PROXY `+host+`; SOCKS5 `+host+`";`))
+	require.True(t, strings.Contains(script, `var remoteDomains = {"google.com":1};`))
+	require.True(t, strings.Contains(script, `var directDomains = {"baidu.com":1};`))
+	// 192.168.0.0/16
+	require.True(t, strings.Contains(script, "[3232235520,3232301055]"))
+	require.True(t, strings.Contains(script, "function FindProxyForURL(url, host)"))
+
+	res, err = http.Get(server.URL + "/wpad.dat")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestPACProxyAddr(t *testing.T) {
+	proxy := &localProxyServer{chinaIPRangeDB: newChinaIPRangeDB()}
+	proxy.pac = newPACFile(proxy)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	fetch := func(host string) string {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/wpad.dat", nil)
+		require.Nil(t, err)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return strings.SplitN(string(body), "\n", 2)[0]
+	}
+
+	// WPAD clients fetch http://wpad/wpad.dat without a port
+	require.Equal(t, `var proxy = "PROXY wpad:`+port+`; SOCKS5 wpad:`+port+`";`, fetch("wpad"))
+	require.Equal(t, `var proxy = "PROXY wpad:`+port+`; SOCKS5 wpad:`+port+`";`, fetch("wpad:80"))
+	// a Host that is not a plain name falls back to the listener address
+	require.Equal(t, `var proxy = "PROXY 127.0.0.1:`+port+`; SOCKS5 127.0.0.1:`+port+`";`, fetch(`x";alert(1);"`))
+}
+
+func TestPACFileLeavesRulesToTheProxy(t *testing.T) {
+	newProxy := func() *localProxyServer {
+		return &localProxyServer{
+			chinaIPRangeDB: newChinaIPRangeDB(),
+			directDomains:  domainSet{"baidu.com": {}},
+			remoteDomains:  domainSet{"google.com": {}},
+		}
+	}
+	chinaRanges := mergeIPv4Ranges(ipv4Ranges(newChinaIPRangeDB()))
+	require.NotEmpty(t, chinaRanges)
+	chinaRange := fmt.Sprintf("[%d,%d]", chinaRanges[len(chinaRanges)/2][0], chinaRanges[len(chinaRanges)/2][1])
+	require.True(t, strings.Contains(newPACFile(newProxy()).script, chinaRange))
+
+	for _, configure := range []func(*localProxyServer){
+		func(p *localProxyServer) { p.forceForwardToRemoteProxy = true },
+		func(p *localProxyServer) { p.rules = ruleSet{{}} },
+		func(p *localProxyServer) { p.blockList = newTestBlockList(t) },
+	} {
+		proxy := newProxy()
+		configure(proxy)
+		script := newPACFile(proxy).script
+		require.True(t, strings.Contains(script, "var remoteDomains = {};"))
+		require.True(t, strings.Contains(script, "var directDomains = {};"))
+		// 192.168.0.0/16
+		require.True(t, strings.Contains(script, "[3232235520,3232301055]"))
+		require.False(t, strings.Contains(script, chinaRange))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// localProxyProvider gives the servers in front of the local proxy the
+// localProxyServer to serve a new connection with.
+type localProxyProvider interface {
+	current() *localProxyServer
+}
+
+func (proxy *localProxyServer) current() *localProxyServer {
+	return proxy
+}
+
+// start runs the background work of the server, that is the health checks
+// of its remote proxies and the loading of the lists fetched from URLs.
+func (proxy *localProxyServer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy.stopBackground = cancel
+	if proxy.healthChecker != nil {
+		go proxy.healthChecker.run(ctx)
+	}
+	if len(proxy.pendingLists) > 0 {
+		go loadPendingLists(ctx, proxy.pendingLists, pendingListRetryInterval)
+	}
+}
+
+// stop ends the background work of the server and drops the idle
+// connections to its remote proxies and to the targets of plain HTTP
+// requests, once a reload has replaced it. Tunnels and requests already in
+// flight through it keep going until they are done.
+func (proxy *localProxyServer) stop() {
+	if proxy.stopBackground != nil {
+		proxy.stopBackground()
+	}
+	closeRemoteProxyClients(proxy.remotes)
+	if transport, ok := proxy.forwardProxy().Transport.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+	if proxy.client != nil {
+		proxy.client.CloseIdleConnections()
+	}
+}
+
+// pendingListRetryInterval is how long to wait before fetching again a
+// list that failed to load.
+const pendingListRetryInterval = time.Minute
+
+// pendingList is a rule provider or a block list fetched from a URL that
+// has not been loaded yet. The server starts without it, rather than
+// waiting for or failing on a URL that may only be reachable through the
+// proxy itself, and the rules using it match nothing until it is loaded.
+type pendingList struct {
+	name   string
+	update func(ctx context.Context) error
+}
+
+// loadPendingLists loads the lists, fetching those that fail again every
+// interval until they are loaded or ctx is done.
+func loadPendingLists(ctx context.Context, lists []pendingList, interval time.Duration) {
+	for {
+		var failed []pendingList
+		for _, list := range lists {
+			if err := list.update(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("failed to load %s, retry in %s: %s", list.name, interval, err)
+				failed = append(failed, list)
+				continue
+			}
+			log.Printf("%s loaded", list.name)
+		}
+		if len(failed) == 0 {
+			return
+		}
+		lists = failed
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadableLocalProxy serves with the localProxyServer built from the
+// latest configuration. A reload builds a complete new server and swaps it
+// in at once, so that a new connection either sees the old configuration or
+// the new one and never a mix, while the connections in flight keep the
+// server they started with.
+type reloadableLocalProxy struct {
+	atomic.Pointer[localProxyServer]
+
+	reloadMu sync.Mutex
+	load     func(prev *localProxyServer) (*localProxyServer, error)
+}
+
+func (p *reloadableLocalProxy) current() *localProxyServer {
+	return p.Load()
+}
+
+func (p *reloadableLocalProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.Load().ServeHTTP(rw, req)
+}
+
+// ServeDNS answers with the resolvers and lists of the current server.
+func (p *reloadableLocalProxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	newDNSServer(p.Load()).ServeDNS(w, req)
+}
+
+// reload builds a new server and swaps it in. The current server is kept
+// when the new configuration is invalid. The member chosen in a select
+// group is carried over to the group of the same name.
+func (p *reloadableLocalProxy) reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	prev := p.Load()
+	next, err := p.load(prev)
+	if err != nil {
+		return err
+	}
+	for name, group := range next.selectGroups {
+		if prevGroup, ok := prev.selectGroups[name]; ok && prevGroup.now() != group.now() {
+			group.choose(prevGroup.now())
+		}
+	}
+
+	next.start()
+	p.Store(next)
+	prev.stop()
+	return nil
+}
+
+// watchFiles calls changed whenever the modification time or the size of
+// any of the files returned by paths changes, checking every interval
+// until ctx is done.
+func watchFiles(ctx context.Context, interval time.Duration, paths func() []string, changed func()) {
+	type stamp struct {
+		modTime time.Time
+		size    int64
+	}
+	stamps := func() map[string]stamp {
+		m := make(map[string]stamp)
+		for _, path := range paths() {
+			if info, err := os.Stat(path); err == nil {
+				m[path] = stamp{modTime: info.ModTime(), size: info.Size()}
+			} else {
+				m[path] = stamp{}
+			}
+		}
+		return m
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := stamps()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := stamps()
+		for path, s := range now {
+			if old, ok := last[path]; ok && old != s {
+				log.Printf("%s changed", path)
+				changed()
+				now = stamps()
+				break
+			}
+		}
+		last = now
+	}
+}
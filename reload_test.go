@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadKeepsTunnelsInFlight(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	hk := &stubTunnelDialer{addr: echo.Addr().String()}
+	jp := &stubTunnelDialer{addr: echo.Addr().String()}
+	first := &localProxyServer{selectGroups: map[string]*remoteProxySelect{
+		"manual": newRemoteProxySelect("manual", []tunnelDialer{hk, jp}),
+	}}
+	require.Nil(t, first.selectGroups["manual"].choose(jp.name()))
+
+	proxy := &reloadableLocalProxy{}
+	proxy.Store(first)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	proxy.load = func(*localProxyServer) (*localProxyServer, error) {
+		return nil, errors.New("invalid configuration")
+	}
+	require.NotNil(t, proxy.reload())
+	require.Same(t, first, proxy.current())
+
+	second := &localProxyServer{
+		blockList: newTestBlockList(t),
+		selectGroups: map[string]*remoteProxySelect{
+			"manual": newRemoteProxySelect("manual", []tunnelDialer{hk, jp}),
+		},
+	}
+	proxy.load = func(prev *localProxyServer) (*localProxyServer, error) {
+		require.Same(t, first, prev)
+		return second, nil
+	}
+	require.Nil(t, proxy.reload())
+	require.Same(t, second, proxy.current())
+	require.Equal(t, jp.name(), second.selectGroups["manual"].now())
+
+	// the tunnel opened before the reload keeps working
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = reader.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// new requests get the new configuration
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	res, err = client.Get("http://ads.example.com/")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestWatchFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	require.Nil(t, os.WriteFile(path, []byte("MATCH,DIRECT\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go watchFiles(ctx, 10*time.Millisecond, func() []string { return []string{path} }, func() {
+		changed <- struct{}{}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-changed:
+		t.Fatal("reloaded without a change")
+	default:
+	}
+
+	require.Nil(t, os.WriteFile(path, []byte("MATCH,REMOTE\n"), 0600))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("no reload after the file changed")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	remoteProxyTransportHTTP1 = "http1"
+	remoteProxyTransportHTTP2 = "http2"
+)
+
+// remoteProxyClient opens tunnels to targets through a remote proxy server.
+// Over HTTP/1.1 every tunnel is a dedicated connection carrying one CONNECT
+// request, optionally taken from a pool of pre-warmed connections. Over
+// HTTP/2 every tunnel is a CONNECT stream multiplexed on a long-lived
+// connection, so only the first tunnel pays for the handshake.
+type remoteProxyClient struct {
+	label     string
+	addr      *url.URL
+	secretKey string
+	tlsConfig *tls.Config
+	timeouts  connTimeouts
+	h2        *http2.Transport
+	pool      *remoteProxyConnPool
+
+	healthy atomic.Bool
+	rtt     atomic.Int64
+}
+
+// newRemoteProxyClient creates a client for the remote proxy at addr.
+// poolSize is the number of idle connections kept for the http1 transport.
+func newRemoteProxyClient(label string, addr *url.URL, secretKey string, transport string, poolSize int, timeouts connTimeouts) (*remoteProxyClient, error) {
+	c := &remoteProxyClient{
+		label:     label,
+		addr:      addr,
+		secretKey: secretKey,
+		timeouts:  timeouts,
+	}
+	c.healthy.Store(true)
+
+	switch transport {
+	case remoteProxyTransportHTTP1:
+		if poolSize > 0 {
+			c.pool = newRemoteProxyConnPool(poolSize, c.dial)
+		}
+	case remoteProxyTransportHTTP2:
+		if addr.Scheme != "https" {
+			return nil, fmt.Errorf("remote proxy transport %s requires an https remote proxy address", transport)
+		}
+		c.h2 = &http2.Transport{
+			DialTLSContext: c.dialTLS,
+			// Detect connections silently dropped on the way to the remote
+			// so that new tunnels do not pile up on a dead connection.
+			ReadIdleTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		}
+	default:
+		return nil, fmt.Errorf("unknown remote proxy transport %q", transport)
+	}
+	return c, nil
+}
+
+func (c *remoteProxyClient) dialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	if c.tlsConfig != nil {
+		serverName := cfg.ServerName
+		cfg = c.tlsConfig.Clone()
+		cfg.NextProtos = []string{http2.NextProtoTLS}
+		if cfg.ServerName == "" {
+			cfg.ServerName = serverName
+		}
+	}
+
+	conn, err := c.timeouts.dialTLS(ctx, network, addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("remote proxy %s does not support HTTP/2, negotiated %q", addr, p)
+	}
+	return conn, nil
+}
+
+// dialTunnel asks the remote proxy to open a tunnel to targetAddr and
+// returns the connection once the tunnel is established.
+func (c *remoteProxyClient) dialTunnel(targetAddr string) (net.Conn, error) {
+	if c.h2 != nil {
+		return c.dialHTTP2Tunnel(targetAddr)
+	}
+	return c.dialHTTP1Tunnel(targetAddr)
+}
+
+func (c *remoteProxyClient) dialHTTP1Tunnel(targetAddr string) (net.Conn, error) {
+	if c.pool != nil {
+		if remoteProxy := c.pool.get(); remoteProxy != nil {
+			conn, err := c.connect(remoteProxy, targetAddr)
+			if err == nil {
+				return conn, nil
+			}
+			// the pooled connection may have died since its last health
+			// check, CONNECT is safe to retry on a fresh one.
+			log.Printf("CONNECT %s on pooled remote proxy connection error: %v", targetAddr, err)
+		}
+	}
+
+	remoteProxy, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return c.connect(remoteProxy, targetAddr)
+}
+
+// close drops the idle connections kept for new tunnels. Tunnels already
+// open are not affected.
+func (c *remoteProxyClient) close() {
+	if c.pool != nil {
+		c.pool.close()
+	}
+	if c.h2 != nil {
+		c.h2.CloseIdleConnections()
+	}
+}
+
+func closeRemoteProxyClients(remotes []*remoteProxyClient) {
+	for _, remote := range remotes {
+		remote.close()
+	}
+}
+
+func (c *remoteProxyClient) name() string {
+	return c.label
+}
+
+func (c *remoteProxyClient) isHealthy() bool {
+	return c.healthy.Load()
+}
+
+// setHealthy records the health of the remote proxy and logs transitions.
+func (c *remoteProxyClient) setHealthy(healthy bool, reason string) {
+	if c.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		log.Printf("remote proxy %s is up: %s", c.label, reason)
+	} else {
+		log.Printf("remote proxy %s is down: %s", c.label, reason)
+	}
+}
+
+// latency returns the round trip time measured by the last successful
+// health check, or 0 if there was none.
+func (c *remoteProxyClient) latency() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *remoteProxyClient) setRTT(rtt time.Duration) {
+	c.rtt.Store(int64(rtt))
+}
+
+// dial opens a connection to the remote proxy and completes the TLS
+// handshake if needed.
+func (c *remoteProxyClient) dial() (net.Conn, error) {
+	var remoteProxy net.Conn
+	var err error
+
+	remoteProxyAddr := appendPort(c.addr.Host, c.addr.Scheme)
+
+	if c.addr.Scheme == "https" {
+		remoteProxy, err = c.timeouts.dialTLS(context.Background(), "tcp", remoteProxyAddr, c.tlsConfig)
+	} else {
+		remoteProxy, err = c.timeouts.dialContext(context.Background(), "tcp", remoteProxyAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial remote proxy %s error: %v", remoteProxyAddr, err)
+	}
+	return remoteProxy, nil
+}
+
+// connect sends CONNECT on remoteProxy and waits for the tunnel to be
+// established. remoteProxy is closed on failure.
+func (c *remoteProxyClient) connect(remoteProxy net.Conn, targetAddr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: targetAddr},
+		Host:   targetAddr,
+		Header: make(http.Header),
+	}
+	req.Header.Set(headerSecret, c.secretKey)
+	if err := req.Write(remoteProxy); err != nil {
+		remoteProxy.Close()
+		return nil, fmt.Errorf("write CONNECT to remote proxy error: %v", err)
+	}
+
+	reader := bufio.NewReader(remoteProxy)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		remoteProxy.Close()
+		return nil, fmt.Errorf("read CONNECT response from remote proxy error: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		remoteProxy.Close()
+		return nil, &remoteProxyStatusError{targetAddr: targetAddr, statusCode: res.StatusCode, status: res.Status}
+	}
+
+	return &bufferedConn{Conn: remoteProxy, reader: reader}, nil
+}
+
+func (c *remoteProxyClient) dialHTTP2Tunnel(targetAddr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: c.addr.Scheme, Host: appendPort(c.addr.Host, c.addr.Scheme)},
+		Host:   targetAddr,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	req.Header.Set(headerSecret, c.secretKey)
+
+	res, err := c.h2.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("remote proxy CONNECT %s over HTTP/2 error: %v", targetAddr, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		pw.Close()
+		return nil, &remoteProxyStatusError{targetAddr: targetAddr, statusCode: res.StatusCode, status: res.Status}
+	}
+
+	return &http2TunnelConn{reader: res.Body, writer: pw, targetAddr: targetAddr}, nil
+}
+
+// http2TunnelConn adapts a CONNECT stream to net.Conn so it can be used in
+// place of a dedicated connection. Deadlines are not supported.
+type http2TunnelConn struct {
+	reader     io.ReadCloser
+	writer     *io.PipeWriter
+	targetAddr string
+}
+
+func (c *http2TunnelConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *http2TunnelConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func (c *http2TunnelConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *http2TunnelConn) LocalAddr() net.Addr {
+	return tunnelAddr("local")
+}
+
+func (c *http2TunnelConn) RemoteAddr() net.Addr {
+	return tunnelAddr(c.targetAddr)
+}
+
+func (c *http2TunnelConn) SetDeadline(_ time.Time) error {
+	return errors.ErrUnsupported
+}
+
+func (c *http2TunnelConn) SetReadDeadline(_ time.Time) error {
+	return errors.ErrUnsupported
+}
+
+func (c *http2TunnelConn) SetWriteDeadline(_ time.Time) error {
+	return errors.ErrUnsupported
+}
+
+// remoteProxyStatusError is returned when the remote proxy answers CONNECT
+// with anything but 200.
+type remoteProxyStatusError struct {
+	targetAddr string
+	statusCode int
+	status     string
+}
+
+func (e *remoteProxyStatusError) Error() string {
+	return fmt.Sprintf("remote proxy CONNECT %s: %s", e.targetAddr, e.status)
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "tunnel"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
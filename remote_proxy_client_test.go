@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteProxyClientHTTP1(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	u, _ := url.Parse(remote.URL)
+	client, err := newRemoteProxyClient("remote", u, "secret", remoteProxyTransportHTTP1, 0, connTimeouts{})
+	require.Nil(t, err)
+
+	conn, err := client.dialTunnel(echo.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	requireEcho(t, conn)
+}
+
+func TestRemoteProxyClientHTTP2(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	remote := httptest.NewUnstartedServer(&remoteProxyServer{secretKey: "secret"})
+	remote.EnableHTTP2 = true
+	remote.StartTLS()
+	defer remote.Close()
+
+	u, _ := url.Parse(remote.URL)
+	client, err := newRemoteProxyClient("remote", u, "secret", remoteProxyTransportHTTP2, 0, connTimeouts{})
+	require.Nil(t, err)
+	client.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+
+	// every tunnel is a stream on the same connection
+	for i := 0; i < 3; i++ {
+		conn, err := client.dialTunnel(echo.Addr().String())
+		require.Nil(t, err)
+		requireEcho(t, conn)
+		defer conn.Close()
+	}
+}
+
+func TestRemoteProxyClientHTTP2RequiresHTTPS(t *testing.T) {
+	u, _ := url.Parse("http://yourdomain.com")
+	_, err := newRemoteProxyClient("remote", u, "secret", remoteProxyTransportHTTP2, 0, connTimeouts{})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelDialer opens tunnels to targets through one or more remote proxies.
+// It is implemented by a single remote proxy as well as by groups of them,
+// so the local proxy does not care which one it is given.
+type tunnelDialer interface {
+	dialTunnel(targetAddr string) (net.Conn, error)
+	name() string
+}
+
+// defaultProxyGroup is the name of the failover group over all remote
+// proxies, used unless another group is chosen.
+const defaultProxyGroup = "failover"
+
+// remoteProxyFailover routes every tunnel to the first healthy remote proxy
+// in order.
+type remoteProxyFailover struct {
+	label   string
+	remotes []*remoteProxyClient
+}
+
+func (g *remoteProxyFailover) dialTunnel(targetAddr string) (net.Conn, error) {
+	return dialInOrder(healthyFirst(g.remotes), targetAddr)
+}
+
+func (g *remoteProxyFailover) name() string {
+	return g.label
+}
+
+// healthyFirst returns remotes with the healthy ones first, keeping the
+// relative order within each half. Unhealthy remotes are tried last rather
+// than skipped: the health state may be stale and trying is better than
+// failing outright.
+func healthyFirst(remotes []*remoteProxyClient) []*remoteProxyClient {
+	ordered := make([]*remoteProxyClient, 0, len(remotes))
+	var unhealthy []*remoteProxyClient
+	for _, remote := range remotes {
+		if remote.isHealthy() {
+			ordered = append(ordered, remote)
+		} else {
+			unhealthy = append(unhealthy, remote)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
+
+// dialInOrder opens a tunnel through the first candidate that works. A
+// remote that fails is marked unhealthy right away, so that new connections
+// fail over without waiting for the next health check.
+func dialInOrder(candidates []*remoteProxyClient, targetAddr string) (net.Conn, error) {
+	var errs []error
+	for _, remote := range candidates {
+		conn, err := remote.dialTunnel(targetAddr)
+		if err == nil {
+			remote.setHealthy(true, "tunnel to "+targetAddr+" established")
+			return conn, nil
+		}
+		if !isRemoteProxyFailure(err) {
+			// the target is unreachable, other remotes would not do better
+			return nil, fmt.Errorf("%s: %v", remote.name(), err)
+		}
+		remote.setHealthy(false, err.Error())
+		errs = append(errs, fmt.Errorf("%s: %v", remote.name(), err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no remote proxy available")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// isRemoteProxyFailure tells whether a dialTunnel error is caused by the
+// remote proxy itself rather than by the target being unreachable from it,
+// which the remote proxy reports with 503.
+func isRemoteProxyFailure(err error) bool {
+	var status *remoteProxyStatusError
+	if errors.As(err, &status) {
+		return status.statusCode != http.StatusServiceUnavailable
+	}
+	return true
+}
+
+const urlTestDefaultTolerance = 50 * time.Millisecond
+
+// remoteProxyURLTest routes tunnels to the healthy remote proxy with the
+// lowest round trip time measured by the health checker. It only switches
+// when another remote is faster by more than tolerance, so that small
+// fluctuations do not make it flap between remotes.
+type remoteProxyURLTest struct {
+	sync.Mutex
+	label     string
+	remotes   []*remoteProxyClient
+	tolerance time.Duration
+	current   *remoteProxyClient
+}
+
+func (g *remoteProxyURLTest) dialTunnel(targetAddr string) (net.Conn, error) {
+	return dialInOrder(g.candidates(), targetAddr)
+}
+
+// candidates returns the chosen remote followed by the others, fastest
+// first, to fail over to.
+func (g *remoteProxyURLTest) candidates() []*remoteProxyClient {
+	ordered := healthyFirst(g.remotes)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.isHealthy() != b.isHealthy() {
+			return a.isHealthy()
+		}
+		return measured(a) < measured(b)
+	})
+
+	g.Lock()
+	defer g.Unlock()
+
+	best := ordered[0]
+	current := g.current
+	if current != nil && current.isHealthy() && current.latency() > 0 && current.latency() <= best.latency()+g.tolerance {
+		best = current
+	}
+	if best != current {
+		log.Printf("proxy group %s switches to %s (rtt %s)", g.label, best.name(), best.latency())
+		g.current = best
+	}
+
+	candidates := []*remoteProxyClient{best}
+	for _, remote := range ordered {
+		if remote != best {
+			candidates = append(candidates, remote)
+		}
+	}
+	return candidates
+}
+
+func (g *remoteProxyURLTest) name() string {
+	return g.label
+}
+
+// measured returns the latency of remote, treating remotes that have not
+// been measured yet as the slowest.
+func measured(remote *remoteProxyClient) time.Duration {
+	if rtt := remote.latency(); rtt > 0 {
+		return rtt
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+const (
+	loadBalanceRoundRobin     = "round-robin"
+	loadBalanceConsistentHash = "consistent-hash"
+)
+
+// remoteProxyLoadBalance spreads tunnels over its remote proxies, either in
+// turn or by hashing the destination host so that every connection to the
+// same site leaves through the same remote and sessions stay sticky.
+type remoteProxyLoadBalance struct {
+	label    string
+	remotes  []*remoteProxyClient
+	strategy string
+	next     atomic.Uint64
+}
+
+func (g *remoteProxyLoadBalance) dialTunnel(targetAddr string) (net.Conn, error) {
+	var ordered []*remoteProxyClient
+	if g.strategy == loadBalanceConsistentHash {
+		host, _, err := net.SplitHostPort(targetAddr)
+		if err != nil {
+			host = targetAddr
+		}
+		ordered = g.byHash(host)
+	} else {
+		ordered = g.byTurn()
+	}
+	return dialInOrder(healthyFirst(ordered), targetAddr)
+}
+
+func (g *remoteProxyLoadBalance) byTurn() []*remoteProxyClient {
+	start := int(g.next.Add(1) % uint64(len(g.remotes)))
+	ordered := make([]*remoteProxyClient, 0, len(g.remotes))
+	ordered = append(ordered, g.remotes[start:]...)
+	return append(ordered, g.remotes[:start]...)
+}
+
+// byHash orders remotes by rendezvous hashing on host: a host keeps its
+// remote as long as that remote is up, and only the hosts of a remote that
+// goes down are moved.
+func (g *remoteProxyLoadBalance) byHash(host string) []*remoteProxyClient {
+	weights := make(map[*remoteProxyClient]uint64, len(g.remotes))
+	for _, remote := range g.remotes {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		h.Write([]byte{0})
+		h.Write([]byte(remote.name()))
+		weights[remote] = h.Sum64()
+	}
+
+	ordered := append([]*remoteProxyClient(nil), g.remotes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return weights[ordered[i]] > weights[ordered[j]]
+	})
+	return ordered
+}
+
+func (g *remoteProxyLoadBalance) name() string {
+	return g.label
+}
+
+// remoteProxySelect routes tunnels through the member chosen at runtime,
+// which may be a remote proxy or another group.
+type remoteProxySelect struct {
+	label    string
+	members  []tunnelDialer
+	selected atomic.Pointer[tunnelDialer]
+}
+
+func newRemoteProxySelect(label string, members []tunnelDialer) *remoteProxySelect {
+	g := &remoteProxySelect{label: label, members: members}
+	g.selected.Store(&members[0])
+	return g
+}
+
+func (g *remoteProxySelect) dialTunnel(targetAddr string) (net.Conn, error) {
+	return (*g.selected.Load()).dialTunnel(targetAddr)
+}
+
+func (g *remoteProxySelect) name() string {
+	return g.label
+}
+
+func (g *remoteProxySelect) now() string {
+	return (*g.selected.Load()).name()
+}
+
+func (g *remoteProxySelect) memberNames() []string {
+	names := make([]string, 0, len(g.members))
+	for _, member := range g.members {
+		names = append(names, member.name())
+	}
+	return names
+}
+
+func (g *remoteProxySelect) choose(name string) error {
+	for i := range g.members {
+		if g.members[i].name() == name {
+			g.selected.Store(&g.members[i])
+			log.Printf("proxy group %s switches to %s", g.label, name)
+			return nil
+		}
+	}
+	return fmt.Errorf("proxy group %s has no member %q", g.label, name)
+}
+
+// parseProxyGroup parses a group of the form name=type[/option]:member|...
+// where type is url-test (option: tolerance, e.g. 50ms), load-balance
+// (option: round-robin or consistent-hash) or select. Members are looked
+// up in dialers; url-test and load-balance groups only take remote proxies.
+func parseProxyGroup(spec string, dialers map[string]tunnelDialer) (tunnelDialer, error) {
+	label, rest, found := strings.Cut(strings.TrimSpace(spec), "=")
+	if !found || label == "" {
+		return nil, fmt.Errorf("invalid proxy group %q, expect name=type:member|...", spec)
+	}
+	typ, memberList, found := strings.Cut(rest, ":")
+	if !found || memberList == "" {
+		return nil, fmt.Errorf("proxy group %s has no members", label)
+	}
+	typ, option, _ := strings.Cut(typ, "/")
+
+	var members []tunnelDialer
+	var remotes []*remoteProxyClient
+	for _, name := range strings.Split(memberList, "|") {
+		member, ok := dialers[name]
+		if !ok {
+			return nil, fmt.Errorf("proxy group %s: unknown member %q", label, name)
+		}
+		members = append(members, member)
+		if remote, ok := member.(*remoteProxyClient); ok {
+			remotes = append(remotes, remote)
+		}
+	}
+
+	switch typ {
+	case "url-test", "load-balance":
+		if len(remotes) != len(members) {
+			return nil, fmt.Errorf("proxy group %s: %s groups only take remote proxies", label, typ)
+		}
+	}
+
+	switch typ {
+	case "url-test":
+		tolerance := urlTestDefaultTolerance
+		if option != "" {
+			var err error
+			if tolerance, err = time.ParseDuration(option); err != nil {
+				return nil, fmt.Errorf("proxy group %s: invalid tolerance: %v", label, err)
+			}
+		}
+		return &remoteProxyURLTest{label: label, remotes: remotes, tolerance: tolerance}, nil
+	case "load-balance":
+		if option == "" {
+			option = loadBalanceRoundRobin
+		}
+		if option != loadBalanceRoundRobin && option != loadBalanceConsistentHash {
+			return nil, fmt.Errorf("proxy group %s: unknown load balance strategy %q", label, option)
+		}
+		return &remoteProxyLoadBalance{label: label, remotes: remotes, strategy: option}, nil
+	case "select":
+		return newRemoteProxySelect(label, members), nil
+	default:
+		return nil, fmt.Errorf("proxy group %s: unknown type %q", label, typ)
+	}
+}
+
+// remoteProxyHealthChecker periodically opens a tunnel to target through
+// every remote proxy and records whether it worked and how long it took.
+type remoteProxyHealthChecker struct {
+	remotes  []*remoteProxyClient
+	target   string
+	interval time.Duration
+}
+
+func (h *remoteProxyHealthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.checkAll()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *remoteProxyHealthChecker) checkAll() {
+	done := make(chan struct{}, len(h.remotes))
+	for _, remote := range h.remotes {
+		go func(remote *remoteProxyClient) {
+			h.check(remote)
+			done <- struct{}{}
+		}(remote)
+	}
+	for range h.remotes {
+		<-done
+	}
+}
+
+func (h *remoteProxyHealthChecker) check(remote *remoteProxyClient) {
+	start := time.Now()
+	conn, err := remote.dialTunnel(h.target)
+	if err != nil {
+		remote.setHealthy(false, "health check: "+err.Error())
+		return
+	}
+	conn.Close()
+	remote.setRTT(time.Since(start))
+	remote.setHealthy(true, "health check passed")
+}
+
+// parseRemoteProxyAddr parses a remote proxy address of the form
+// scheme://[secret@]host[:port][#name]. The secret defaults to
+// defaultSecret and the name to the host.
+func parseRemoteProxyAddr(raw, defaultSecret string) (addr *url.URL, label, secret string, err error) {
+	if addr, err = url.Parse(strings.TrimSpace(raw)); err != nil {
+		return nil, "", "", err
+	}
+	if addr.Scheme != "https" && addr.Scheme != "http" {
+		return nil, "", "", fmt.Errorf("unsupported scheme %q in %s", addr.Scheme, raw)
+	}
+	if addr.Host == "" {
+		return nil, "", "", fmt.Errorf("missing host in %s", raw)
+	}
+
+	secret = defaultSecret
+	if addr.User != nil {
+		secret = addr.User.Username()
+		if password, ok := addr.User.Password(); ok {
+			secret += ":" + password
+		}
+	}
+	label = addr.Fragment
+	if label == "" {
+		label = addr.Host
+	}
+
+	addr.User = nil
+	addr.Fragment = ""
+	return addr, label, secret, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRemoteProxyClient(t *testing.T, label, rawURL string) *remoteProxyClient {
+	u, err := url.Parse(rawURL)
+	require.Nil(t, err)
+	client, err := newRemoteProxyClient(label, u, "secret", remoteProxyTransportHTTP1, 0, connTimeouts{})
+	require.Nil(t, err)
+	return client
+}
+
+// newDeadAddr returns the address of a port nobody listens on.
+func newDeadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestRemoteProxyFailover(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	dead := newTestRemoteProxyClient(t, "dead", "http://"+newDeadAddr(t))
+	alive := newTestRemoteProxyClient(t, "alive", remote.URL)
+	failover := &remoteProxyFailover{label: "failover", remotes: []*remoteProxyClient{dead, alive}}
+
+	conn, err := failover.dialTunnel(echo.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	requireEcho(t, conn)
+
+	require.False(t, dead.isHealthy())
+	require.True(t, alive.isHealthy())
+}
+
+func TestRemoteProxyFailoverKeepsRemoteOnUnreachableTarget(t *testing.T) {
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	first := newTestRemoteProxyClient(t, "first", remote.URL)
+	second := newTestRemoteProxyClient(t, "second", "http://"+newDeadAddr(t))
+	failover := &remoteProxyFailover{label: "failover", remotes: []*remoteProxyClient{first, second}}
+
+	_, err := failover.dialTunnel(newDeadAddr(t))
+	require.NotNil(t, err)
+	require.True(t, first.isHealthy())
+	require.True(t, second.isHealthy())
+}
+
+func TestRemoteProxyHealthChecker(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	dead := newTestRemoteProxyClient(t, "dead", "http://"+newDeadAddr(t))
+	alive := newTestRemoteProxyClient(t, "alive", remote.URL)
+	h := &remoteProxyHealthChecker{
+		remotes:  []*remoteProxyClient{dead, alive},
+		target:   echo.Addr().String(),
+		interval: time.Minute,
+	}
+	h.checkAll()
+
+	require.False(t, dead.isHealthy())
+	require.True(t, alive.isHealthy())
+	require.NotZero(t, alive.latency())
+}
+
+func TestParseRemoteProxyAddr(t *testing.T) {
+	u, label, secret, err := parseRemoteProxyAddr("https://s3cret@hk.example.com:8443#hk", "default")
+	require.Nil(t, err)
+	require.Equal(t, "https://hk.example.com:8443", u.String())
+	require.Equal(t, "hk", label)
+	require.Equal(t, "s3cret", secret)
+
+	u, label, secret, err = parseRemoteProxyAddr("https://yourdomain.com", "default")
+	require.Nil(t, err)
+	require.Equal(t, "https://yourdomain.com", u.String())
+	require.Equal(t, "yourdomain.com", label)
+	require.Equal(t, "default", secret)
+
+	_, _, _, err = parseRemoteProxyAddr("socks5://yourdomain.com", "default")
+	require.NotNil(t, err)
+}
+
+func TestRemoteProxyURLTest(t *testing.T) {
+	hk := newTestRemoteProxyClient(t, "hk", "https://hk.example.com")
+	jp := newTestRemoteProxyClient(t, "jp", "https://jp.example.com")
+	sg := newTestRemoteProxyClient(t, "sg", "https://sg.example.com")
+	g := &remoteProxyURLTest{label: "auto", remotes: []*remoteProxyClient{hk, jp, sg}, tolerance: 50 * time.Millisecond}
+
+	hk.setRTT(200 * time.Millisecond)
+	jp.setRTT(100 * time.Millisecond)
+	require.Equal(t, []*remoteProxyClient{jp, hk, sg}, g.candidates())
+
+	// within tolerance, stay on jp
+	hk.setRTT(80 * time.Millisecond)
+	require.Equal(t, jp, g.candidates()[0])
+
+	// beyond tolerance, switch to hk
+	hk.setRTT(40 * time.Millisecond)
+	require.Equal(t, hk, g.candidates()[0])
+
+	// unhealthy remotes are only fallbacks
+	hk.setHealthy(false, "test")
+	require.Equal(t, []*remoteProxyClient{jp, sg, hk}, g.candidates())
+}
+
+func TestRemoteProxyLoadBalance(t *testing.T) {
+	hk := newTestRemoteProxyClient(t, "hk", "https://hk.example.com")
+	jp := newTestRemoteProxyClient(t, "jp", "https://jp.example.com")
+	sg := newTestRemoteProxyClient(t, "sg", "https://sg.example.com")
+	remotes := []*remoteProxyClient{hk, jp, sg}
+
+	rr := &remoteProxyLoadBalance{label: "rr", remotes: remotes, strategy: loadBalanceRoundRobin}
+	first := rr.byTurn()[0]
+	second := rr.byTurn()[0]
+	third := rr.byTurn()[0]
+	require.ElementsMatch(t, remotes, []*remoteProxyClient{first, second, third})
+
+	hash := &remoteProxyLoadBalance{label: "hash", remotes: remotes, strategy: loadBalanceConsistentHash}
+	chosen := hash.byHash("www.google.com")[0]
+	for i := 0; i < 10; i++ {
+		require.Equal(t, chosen, hash.byHash("www.google.com")[0])
+	}
+
+	// removing another remote does not move the host
+	var others []*remoteProxyClient
+	for _, remote := range remotes {
+		if remote != chosen {
+			others = append(others, remote)
+		}
+	}
+	smaller := &remoteProxyLoadBalance{label: "hash", remotes: []*remoteProxyClient{chosen, others[0]}, strategy: loadBalanceConsistentHash}
+	require.Equal(t, chosen, smaller.byHash("www.google.com")[0])
+}
+
+func TestParseProxyGroup(t *testing.T) {
+	hk := newTestRemoteProxyClient(t, "hk", "https://hk.example.com")
+	jp := newTestRemoteProxyClient(t, "jp", "https://jp.example.com")
+	dialers := map[string]tunnelDialer{"hk": hk, "jp": jp}
+
+	g, err := parseProxyGroup("auto=url-test/100ms:hk|jp", dialers)
+	require.Nil(t, err)
+	require.Equal(t, 100*time.Millisecond, g.(*remoteProxyURLTest).tolerance)
+	dialers["auto"] = g
+
+	g, err = parseProxyGroup("lb=load-balance/consistent-hash:hk|jp", dialers)
+	require.Nil(t, err)
+	require.Equal(t, loadBalanceConsistentHash, g.(*remoteProxyLoadBalance).strategy)
+
+	g, err = parseProxyGroup("manual=select:auto|hk|jp", dialers)
+	require.Nil(t, err)
+	s := g.(*remoteProxySelect)
+	require.Equal(t, "auto", s.now())
+	require.Nil(t, s.choose("jp"))
+	require.Equal(t, "jp", s.now())
+	require.NotNil(t, s.choose("sg"))
+
+	_, err = parseProxyGroup("bad=url-test:auto|hk", dialers)
+	require.NotNil(t, err)
+	_, err = parseProxyGroup("bad=select:sg", dialers)
+	require.NotNil(t, err)
+	_, err = parseProxyGroup("bad=fastest:hk", dialers)
+	require.NotNil(t, err)
+	_, err = parseProxyGroup("bad", dialers)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// remoteProxyPoolMaxIdle is how long a pooled connection may wait to be
+	// used; older connections are likely to have been dropped by a
+	// middlebox along the way. The remote proxy only bounds the TLS
+	// handshake and never closes a connection waiting for its CONNECT.
+	remoteProxyPoolMaxIdle             = 90 * time.Second
+	remoteProxyPoolHealthCheckInterval = 15 * time.Second
+)
+
+// remoteProxyConnPool keeps idle connections to the remote proxy whose TCP
+// and TLS handshakes are already done, so that a new tunnel only pays for
+// its CONNECT round trip. The pool is replenished and health-checked in the
+// background.
+type remoteProxyConnPool struct {
+	size int
+	dial func() (net.Conn, error)
+
+	conns     chan *pooledConn
+	refill    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pooledConn struct {
+	net.Conn
+	createdAt time.Time
+}
+
+func newRemoteProxyConnPool(size int, dial func() (net.Conn, error)) *remoteProxyConnPool {
+	p := &remoteProxyConnPool{
+		size:   size,
+		dial:   dial,
+		conns:  make(chan *pooledConn, size),
+		refill: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// get returns a healthy idle connection, or nil if the pool is empty.
+func (p *remoteProxyConnPool) get() net.Conn {
+	defer p.requestRefill()
+	for {
+		select {
+		case c := <-p.conns:
+			if c.healthy() {
+				return c.Conn
+			}
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *remoteProxyConnPool) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+func (p *remoteProxyConnPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *remoteProxyConnPool) run() {
+	ticker := time.NewTicker(remoteProxyPoolHealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.fill()
+		select {
+		case <-p.refill:
+		case <-ticker.C:
+			p.check()
+		case <-p.closed:
+			p.drain()
+			return
+		}
+	}
+}
+
+// fill dials until the pool is full. A failed dial is retried on the next
+// health check or when a connection is taken from the pool.
+func (p *remoteProxyConnPool) fill() {
+	for len(p.conns) < p.size {
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+
+		conn, err := p.dial()
+		if err != nil {
+			log.Printf("fill remote proxy connection pool error: %v", err)
+			return
+		}
+
+		select {
+		case p.conns <- &pooledConn{Conn: conn, createdAt: time.Now()}:
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (p *remoteProxyConnPool) check() {
+	for n := len(p.conns); n > 0; n-- {
+		select {
+		case c := <-p.conns:
+			if !c.healthy() {
+				c.Close()
+				continue
+			}
+			select {
+			case p.conns <- c:
+			default:
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *remoteProxyConnPool) drain() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// healthy reports whether the connection is still usable. The remote proxy
+// never sends anything before it receives a request, so a read must time
+// out; EOF or unexpected data means the connection is gone.
+func (c *pooledConn) healthy() bool {
+	if time.Since(c.createdAt) > remoteProxyPoolMaxIdle {
+		return false
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := c.Read(make([]byte, 1))
+	c.SetReadDeadline(time.Time{})
+	return n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPooledConnHealthy(t *testing.T) {
+	client, server := net.Pipe()
+	c := &pooledConn{Conn: client, createdAt: time.Now()}
+	require.True(t, c.healthy())
+
+	c.createdAt = time.Now().Add(-remoteProxyPoolMaxIdle - time.Second)
+	require.False(t, c.healthy())
+
+	c.createdAt = time.Now()
+	server.Close()
+	require.False(t, c.healthy())
+}
+
+func TestRemoteProxyClientUsesPool(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	u, _ := url.Parse(remote.URL)
+	client, err := newRemoteProxyClient("remote", u, "secret", remoteProxyTransportHTTP1, 2, connTimeouts{})
+	require.Nil(t, err)
+	defer client.pool.close()
+
+	require.Eventually(t, func() bool {
+		return len(client.pool.conns) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := client.dialTunnel(echo.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	requireEcho(t, conn)
+
+	// the pool is replenished after a connection is taken
+	require.Eventually(t, func() bool {
+		return len(client.pool.conns) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRemoteProxyClientRetriesDeadPooledConn(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	remote := httptest.NewServer(&remoteProxyServer{secretKey: "secret"})
+	defer remote.Close()
+
+	u, _ := url.Parse(remote.URL)
+	client, err := newRemoteProxyClient("remote", u, "secret", remoteProxyTransportHTTP1, 1, connTimeouts{})
+	require.Nil(t, err)
+	defer client.pool.close()
+
+	require.Eventually(t, func() bool {
+		return len(client.pool.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	remote.CloseClientConnections()
+
+	conn, err := client.dialTunnel(echo.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	requireEcho(t, conn)
+}
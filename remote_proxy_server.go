@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 
 	"github.com/juju/ratelimit"
 )
@@ -16,6 +17,11 @@ type remoteProxyServer struct {
 	secretKey              string
 	staticReversedAddr     string
 	enableWebsiteRatelimit bool
+	tunnels                *tunnelTracker
+	timeouts               connTimeouts
+
+	forwarderOnce sync.Once
+	forwarder     *httputil.ReverseProxy
 }
 
 func (proxy *remoteProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -29,24 +35,91 @@ func (proxy *remoteProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Requ
 
 func (proxy *remoteProxyServer) forwardToTarget(rw http.ResponseWriter, req *http.Request) {
 	req.Header.Del(headerSecret)
+
+	if req.Method != http.MethodConnect {
+		proxy.forwardProxy().ServeHTTP(rw, req)
+		return
+	}
+
+	if req.ProtoMajor == 2 {
+		proxy.forwardHTTP2StreamToTarget(rw, req)
+		return
+	}
+
+	// tracked from now on, so that a shutdown does not miss the tunnel
+	// between the HTTP server letting go of it and the relay starting
+	defer proxy.tunnels.accept(nil)()
+
 	targetAddr := appendPort(req.Host, req.URL.Scheme)
 
-	target, err := net.Dial("tcp", targetAddr)
+	target, err := proxy.timeouts.dialContext(context.Background(), "tcp", targetAddr)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	localProxy, _, _ := rw.(http.Hijacker).Hijack()
+	localProxy := hijack(rw)
+	localProxy.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+
+	proxy.tunnels.relay(localProxy, target)
+}
+
+// forwardProxy returns the proxy for plain HTTP requests, which resolves
+// and dials every target itself.
+func (proxy *remoteProxyServer) forwardProxy() *httputil.ReverseProxy {
+	proxy.forwarderOnce.Do(func() {
+		proxy.forwarder = newForwardProxy(newForwardTransport(proxy.timeouts.dialContext, proxy.timeouts))
+	})
+	return proxy.forwarder
+}
 
-	if req.Method == http.MethodConnect {
-		localProxy.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
-	} else {
-		req.Write(target)
+// forwardHTTP2StreamToTarget serves a CONNECT stream multiplexed on an
+// HTTP/2 connection. Such streams cannot be hijacked, so the request body
+// and the response are piped to and from the target instead.
+func (proxy *remoteProxyServer) forwardHTTP2StreamToTarget(rw http.ResponseWriter, req *http.Request) {
+	target, err := proxy.timeouts.dialContext(context.Background(), "tcp", req.Host)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer target.Close()
+
+	watch := proxy.tunnels.watchIdle(func() {
+		target.Close()
+	})
+	defer func() {
+		if watch.stop() {
+			proxy.tunnels.countIdleTimedOut(req.RemoteAddr, req.Host, watch.timeout)
+		}
+	}()
+	target = watch.conn(target)
+
+	rw.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(rw)
+	if err := rc.Flush(); err != nil {
+		return
 	}
 
-	go transfer(localProxy, target)
-	transfer(target, localProxy)
+	go func() {
+		io.Copy(target, req.Body)
+		target.Close()
+	}()
+	io.Copy(&flushWriter{w: rw, rc: rc}, target)
+}
+
+// flushWriter flushes after every write so that tunneled bytes are sent
+// right away instead of sitting in the response buffer.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
 }
 
 func (proxy *remoteProxyServer) serveAsWebsite(rw http.ResponseWriter, req *http.Request) {
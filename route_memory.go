@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+type route uint8
+
+const (
+	routeDirect route = iota + 1
+	routeRemote
+)
+
+func (r route) String() string {
+	switch r {
+	case routeDirect:
+		return "direct"
+	case routeRemote:
+		return "remote"
+	}
+	return "unknown"
+}
+
+func (r route) other() route {
+	if r == routeDirect {
+		return routeRemote
+	}
+	return routeDirect
+}
+
+// routeMemory remembers, per host, the route that worked after the one
+// chosen by the routing rules failed, so that later connections to the host
+// do not have to wait for the failing route again.
+type routeMemory struct {
+	sync.Mutex
+	ttl   time.Duration
+	cache *lru.Cache
+}
+
+type rememberedRoute struct {
+	route     route
+	expiredAt time.Time
+}
+
+func newRouteMemory(size int, ttl time.Duration) *routeMemory {
+	return &routeMemory{
+		ttl:   ttl,
+		cache: lru.New(size),
+	}
+}
+
+// get returns the remembered route for host, or 0 if there is none. A nil
+// routeMemory remembers nothing.
+func (m *routeMemory) get(host string) route {
+	if m == nil {
+		return 0
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	v, ok := m.cache.Get(host)
+	if !ok {
+		return 0
+	}
+	remembered := v.(rememberedRoute)
+	if remembered.expiredAt.Before(time.Now()) {
+		m.cache.Remove(host)
+		return 0
+	}
+	return remembered.route
+}
+
+func (m *routeMemory) remember(host string, r route) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.cache.Add(host, rememberedRoute{route: r, expiredAt: time.Now().Add(m.ttl)})
+}
+
+func (m *routeMemory) forget(host string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.cache.Remove(host)
+}
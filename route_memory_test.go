@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteMemory(t *testing.T) {
+	m := newRouteMemory(2, time.Minute)
+	require.Equal(t, route(0), m.get("a.com"))
+
+	m.remember("a.com", routeRemote)
+	require.Equal(t, routeRemote, m.get("a.com"))
+
+	m.remember("b.com", routeDirect)
+	m.remember("c.com", routeDirect)
+	require.Equal(t, route(0), m.get("a.com"))
+
+	m.forget("b.com")
+	require.Equal(t, route(0), m.get("b.com"))
+
+	expired := newRouteMemory(2, -time.Second)
+	expired.remember("a.com", routeRemote)
+	require.Equal(t, route(0), expired.get("a.com"))
+
+	var none *routeMemory
+	none.remember("a.com", routeRemote)
+	require.Equal(t, route(0), none.get("a.com"))
+}
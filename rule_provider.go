@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ruleProviderGFWList = "gfwlist"
+	ruleProviderDnsmasq = "dnsmasq"
+	ruleProviderGeoSite = "geosite"
+	ruleProviderGeoIP   = "geoip"
+)
+
+// ruleProvider is a community maintained list of domains or IP ranges that
+// rules can refer to. It is loaded from a local file or an http(s) URL and
+// reloaded by update, so rules keep a pointer to the provider rather than
+// to its content.
+type ruleProvider struct {
+	name     string
+	format   string
+	location string
+	client   *http.Client
+
+	sync.RWMutex
+	domains  *domainMatcher
+	sites    map[string][]geoSiteDomain
+	matchers map[string]*domainMatcher
+	ips      map[string]*cidrSet
+	ready    bool
+}
+
+// parseRuleProvider parses a spec in the form name=format:location.
+func parseRuleProvider(spec string, client *http.Client) (*ruleProvider, error) {
+	name, rest, found := strings.Cut(spec, "=")
+	if !found || name == "" {
+		return nil, fmt.Errorf("invalid rule provider %q, expect name=format:location", spec)
+	}
+	format, location, found := strings.Cut(rest, ":")
+	if !found || location == "" {
+		return nil, fmt.Errorf("invalid rule provider %q, expect name=format:location", spec)
+	}
+	switch format {
+	case ruleProviderGFWList, ruleProviderDnsmasq, ruleProviderGeoSite, ruleProviderGeoIP:
+	default:
+		return nil, fmt.Errorf("unknown rule provider format %q", format)
+	}
+	return &ruleProvider{
+		name:     name,
+		format:   format,
+		location: location,
+		client:   client,
+		matchers: make(map[string]*domainMatcher),
+	}, nil
+}
+
+// update fetches the provider's data again and swaps it in.
+func (p *ruleProvider) update(ctx context.Context) error {
+	data, err := p.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	var domains *domainMatcher
+	var sites map[string][]geoSiteDomain
+	var ips map[string]*cidrSet
+	switch p.format {
+	case ruleProviderGFWList:
+		domains, err = parseGFWList(data)
+	case ruleProviderDnsmasq:
+		domains = parseDnsmasqList(data)
+	case ruleProviderGeoSite:
+		sites, err = parseGeoSiteList(data)
+	case ruleProviderGeoIP:
+		ips, err = parseGeoIPList(data)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s rule provider %s error: %v", p.format, p.name, err)
+	}
+
+	p.Lock()
+	p.domains = domains
+	p.sites = sites
+	p.matchers = make(map[string]*domainMatcher)
+	p.ips = ips
+	p.ready = true
+	p.Unlock()
+	return nil
+}
+
+// loaded reports whether the provider's data has been loaded once.
+func (p *ruleProvider) loaded() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.ready
+}
+
+// takeOver uses the data prev has loaded from the same location, so that a
+// reload does not leave the provider empty while it is fetched again.
+func (p *ruleProvider) takeOver(prev *ruleProvider) {
+	if prev.format != p.format || prev.location != p.location {
+		return
+	}
+	prev.RLock()
+	domains, sites, ips, ready := prev.domains, prev.sites, prev.ips, prev.ready
+	prev.RUnlock()
+
+	p.Lock()
+	p.domains = domains
+	p.sites = sites
+	p.matchers = make(map[string]*domainMatcher)
+	p.ips = ips
+	p.ready = ready
+	p.Unlock()
+}
+
+func (p *ruleProvider) fetch(ctx context.Context) ([]byte, error) {
+	return fetchList(ctx, p.client, p.location)
+}
+
+// isListURL reports whether a list is fetched from an http(s) URL rather
+// than read from a local file.
+func isListURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetchList reads a list from a local file or an http(s) URL.
+func fetchList(ctx context.Context, client *http.Client, location string) ([]byte, error) {
+	if !isListURL(location) {
+		return os.ReadFile(location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", location, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// matchDomain reports whether host is in a gfwlist or dnsmasq provider.
+func (p *ruleProvider) matchDomain(host string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.domains.match(host)
+}
+
+// hasSite reports whether a geosite provider has the category.
+func (p *ruleProvider) hasSite(category string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	_, ok := p.sites[category]
+	return ok
+}
+
+// matchSite reports whether host is in the geosite category, optionally
+// restricted to the domains carrying the attribute attr. The matcher of a
+// category is built the first time it is used.
+func (p *ruleProvider) matchSite(category, attr, host string) bool {
+	key := category + "@" + attr
+	p.RLock()
+	m, ok := p.matchers[key]
+	p.RUnlock()
+	if !ok {
+		p.Lock()
+		if m, ok = p.matchers[key]; !ok {
+			m = newGeoSiteMatcher(p.sites[category], attr)
+			p.matchers[key] = m
+		}
+		p.Unlock()
+	}
+	return m.match(host)
+}
+
+// geoIP returns the IP ranges of the country in a geoip provider, or nil.
+func (p *ruleProvider) geoIP(country string) *cidrSet {
+	p.RLock()
+	defer p.RUnlock()
+	return p.ips[country]
+}
+
+// domainMatcher matches a host against full domains, domain suffixes,
+// keywords and regular expressions, minus the excluded suffixes.
+type domainMatcher struct {
+	full     map[string]struct{}
+	suffixes domainSet
+	keywords []string
+	regexps  []*regexp.Regexp
+	excludes domainSet
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{
+		full:     make(map[string]struct{}),
+		suffixes: make(domainSet),
+		excludes: make(domainSet),
+	}
+}
+
+func (m *domainMatcher) match(host string) bool {
+	if m == nil {
+		return false
+	}
+	host = normalizeDomain(host)
+	if m.excludes.contains(host) {
+		return false
+	}
+	if _, ok := m.full[host]; ok {
+		return true
+	}
+	if m.suffixes.contains(host) {
+		return true
+	}
+	for _, keyword := range m.keywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrSet holds IP ranges with IPv4 and IPv6 kept apart, so that an IPv4
+// address is never compared with an IPv6 range.
+type cidrSet struct {
+	v4      *iPRangeDB
+	v6      *iPRangeDB
+	reverse bool
+}
+
+func newCIDRSet(nets []*net.IPNet, reverse bool) *cidrSet {
+	s := &cidrSet{v4: &iPRangeDB{}, v6: &iPRangeDB{}, reverse: reverse}
+	for _, n := range nets {
+		r := &ipRange{value: n.String()}
+		if n.IP.To4() != nil {
+			s.v4.db = append(s.v4.db, r)
+		} else {
+			s.v6.db = append(s.v6.db, r)
+		}
+	}
+	for _, db := range []*iPRangeDB{s.v4, s.v6} {
+		db.init()
+		sort.Sort(db)
+	}
+	return s
+}
+
+func (s *cidrSet) contains(ip net.IP) bool {
+	if s == nil || ip == nil {
+		return false
+	}
+	var found bool
+	if ip.To4() != nil {
+		found = s.v4.contains(ip)
+	} else {
+		found = s.v6.contains(ip)
+	}
+	return found != s.reverse
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRuleProvider(t *testing.T) {
+	p, err := parseRuleProvider("gfw=gfwlist:https://example.com/gfwlist.txt", http.DefaultClient)
+	require.Nil(t, err)
+	require.Equal(t, "gfw", p.name)
+	require.Equal(t, ruleProviderGFWList, p.format)
+	require.Equal(t, "https://example.com/gfwlist.txt", p.location)
+
+	for _, spec := range []string{"gfw", "=gfwlist:a.txt", "gfw=gfwlist", "gfw=adblock:a.txt"} {
+		_, err := parseRuleProvider(spec, http.DefaultClient)
+		require.NotNil(t, err, spec)
+	}
+}
+
+func TestRuleProvidersInRules(t *testing.T) {
+	gfwList := base64.StdEncoding.EncodeToString([]byte("||google.com\n"))
+	served := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		served++
+		rw.Write([]byte(gfwList))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	chinaList := filepath.Join(dir, "accelerated-domains.china.conf")
+	require.Nil(t, os.WriteFile(chinaList, []byte("server=/baidu.com/114.114.114.114\n"), 0600))
+	geoSite := filepath.Join(dir, "geosite.dat")
+	require.Nil(t, os.WriteFile(geoSite, newTestGeoSiteData(), 0600))
+	geoIP := filepath.Join(dir, "geoip.dat")
+	require.Nil(t, os.WriteFile(geoIP, newTestGeoIPData(), 0600))
+
+	sources := &ruleSources{}
+	for _, spec := range []string{
+		"gfw=gfwlist:" + server.URL,
+		"china=dnsmasq:" + chinaList,
+		"site=geosite:" + geoSite,
+		"ip=geoip:" + geoIP,
+	} {
+		p, err := parseRuleProvider(spec, server.Client())
+		require.Nil(t, err)
+		require.Nil(t, p.update(context.Background()))
+		sources.providers = append(sources.providers, p)
+	}
+	require.Equal(t, 1, served)
+
+	var rules ruleSet
+	for _, line := range []string{
+		"RULE-SET,china,DIRECT",
+		"GEOSITE,google@cn,DIRECT",
+		"RULE-SET,gfw,REMOTE",
+		"GEOSITE,cn,DIRECT",
+		"GEOIP,JP,REJECT",
+	} {
+		r, err := parseRule(line, nil, &stubTunnelDialer{}, sources)
+		require.Nil(t, err, line)
+		rules = append(rules, r)
+	}
+
+	require.Equal(t, "DIRECT", matchRule(rules, "", "www.baidu.com", 443))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "www.google.cn", 443))
+	require.Equal(t, "REMOTE", matchRule(rules, "", "www.google.com", 443))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "www.gov.cn", 443))
+	require.Equal(t, "REJECT", matchRule(rules, "", "www.example.jp", 443, "1.0.16.1"))
+	require.Equal(t, "", matchRule(rules, "", "www.example.com", 443, "8.8.8.8"))
+
+	for _, line := range []string{"RULE-SET,site,DIRECT", "RULE-SET,none,DIRECT", "GEOSITE,netflix,REMOTE", "GEOIP,US,DIRECT"} {
+		_, err := parseRule(line, nil, &stubTunnelDialer{}, sources)
+		require.NotNil(t, err, line)
+	}
+}
+
+func TestRuleProviderLoadedLater(t *testing.T) {
+	geoSite := newTestGeoSiteData()
+	var served atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if served.Add(1) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write(geoSite)
+	}))
+	defer server.Close()
+
+	p, err := parseRuleProvider("site=geosite:"+server.URL, server.Client())
+	require.Nil(t, err)
+	sources := &ruleSources{providers: []*ruleProvider{p}}
+
+	// the categories of a provider that is not loaded yet are accepted and
+	// match nothing until it is
+	r, err := parseRule("GEOSITE,google@cn,DIRECT", nil, &stubTunnelDialer{}, sources)
+	require.Nil(t, err)
+	rules := ruleSet{r}
+	require.Equal(t, "", matchRule(rules, "", "www.google.cn", 443))
+
+	loadPendingLists(context.Background(), []pendingList{{name: "site", update: p.update}}, 10*time.Millisecond)
+	require.EqualValues(t, 2, served.Load())
+	require.True(t, p.loaded())
+	require.Equal(t, "DIRECT", matchRule(rules, "", "www.google.cn", 443))
+	_, err = parseRule("GEOSITE,netflix,REMOTE", nil, &stubTunnelDialer{}, sources)
+	require.NotNil(t, err)
+
+	// a reload uses the data loaded from the same location
+	next, err := parseRuleProvider("site=geosite:"+server.URL, server.Client())
+	require.Nil(t, err)
+	next.takeOver(p)
+	require.True(t, next.loaded())
+	require.True(t, next.hasSite("google"))
+	other, err := parseRuleProvider("site=geosite:"+server.URL+"/other", server.Client())
+	require.Nil(t, err)
+	other.takeOver(p)
+	require.False(t, other.loaded())
+}
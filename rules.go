@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ruleActionDirect = "DIRECT"
+	ruleActionRemote = "REMOTE"
+	ruleActionReject = "REJECT"
+)
+
+// errRejected is returned by localProxyServer.connect when a REJECT rule
+// matches the target.
+var errRejected = errors.New("rejected by rule")
+
+// ruleSources holds the IP ranges and rule providers that rules refer to
+// by name.
+type ruleSources struct {
+	geoIP     map[string]*iPRangeDB
+	providers []*ruleProvider
+}
+
+// provider returns the first provider of the format, or nil.
+func (s *ruleSources) provider(format string) *ruleProvider {
+	if s == nil {
+		return nil
+	}
+	for _, p := range s.providers {
+		if p.format == format {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *ruleSources) namedProvider(name string) *ruleProvider {
+	if s == nil {
+		return nil
+	}
+	for _, p := range s.providers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// ruleTarget is what rules are matched against. The addresses of host are
+// only resolved when an IP rule is reached, so that domain rules listed
+// first never wait for DNS. With noResolve, IP rules only match targets
+// that are IP addresses.
+type ruleTarget struct {
+	srcIP     net.IP
+	host      string
+	port      int
+	resolve   func(host string) ([]net.IP, <-chan []net.IP)
+	noResolve bool
+
+	ips      []net.IP
+	late     <-chan []net.IP
+	resolved bool
+}
+
+// targetIPs returns the addresses of host known so far, as resolve does;
+// those of the address family that answers later are delivered by late.
+func (t *ruleTarget) targetIPs() []net.IP {
+	if !t.resolved {
+		t.resolved = true
+		t.ips, t.late = t.resolve(t.host)
+	}
+	return t.ips
+}
+
+// ruleAction tells how to connect a matched target. remote is nil for
+// DIRECT and REJECT.
+type ruleAction struct {
+	name   string
+	remote tunnelDialer
+}
+
+type rule struct {
+	typ       string
+	value     string
+	action    ruleAction
+	noResolve bool
+	match     func(t *ruleTarget) bool
+}
+
+// ruleSet is an ordered list of rules, the first matching rule wins.
+type ruleSet []*rule
+
+// loadRules reads one rule per line in the form TYPE,VALUE,ACTION[,no-resolve]
+// or MATCH,ACTION. ACTION is DIRECT, REJECT, REMOTE for the default remote
+// proxy group, or REMOTE:name for a named remote proxy or group. Empty lines
+// and lines starting with '#' are ignored.
+func loadRules(path string, dialers map[string]tunnelDialer, defaultRemote tunnelDialer, sources *ruleSources) (ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules ruleSet
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line, dialers, defaultRemote, sources)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseRule(line string, dialers map[string]tunnelDialer, defaultRemote tunnelDialer, sources *ruleSources) (*rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	r := &rule{typ: strings.ToUpper(fields[0])}
+	var action string
+	if r.typ == "MATCH" {
+		if len(fields) != 2 {
+			return nil, errors.New("expect MATCH,ACTION")
+		}
+		action = fields[1]
+		r.match = func(*ruleTarget) bool { return true }
+	} else {
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, errors.New("expect TYPE,VALUE,ACTION[,no-resolve]")
+		}
+		r.value, action = fields[1], fields[2]
+		if len(fields) == 4 {
+			if !strings.EqualFold(fields[3], "no-resolve") {
+				return nil, fmt.Errorf("unknown rule option %q", fields[3])
+			}
+			r.noResolve = true
+		}
+		if err := r.compile(sources); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if r.action, err = parseRuleAction(action, dialers, defaultRemote); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseRuleAction(value string, dialers map[string]tunnelDialer, defaultRemote tunnelDialer) (ruleAction, error) {
+	kind, name, named := strings.Cut(value, ":")
+	switch strings.ToUpper(kind) {
+	case ruleActionDirect:
+		if !named {
+			return ruleAction{name: ruleActionDirect}, nil
+		}
+	case ruleActionReject:
+		if !named {
+			return ruleAction{name: ruleActionReject}, nil
+		}
+	case ruleActionRemote:
+		if !named {
+			return ruleAction{name: ruleActionRemote, remote: defaultRemote}, nil
+		}
+		remote, ok := dialers[name]
+		if !ok {
+			return ruleAction{}, fmt.Errorf("unknown remote proxy or group %q", name)
+		}
+		return ruleAction{name: ruleActionRemote + ":" + name, remote: remote}, nil
+	}
+	return ruleAction{}, fmt.Errorf("unknown rule action %q", value)
+}
+
+func (r *rule) compile(sources *ruleSources) error {
+	switch r.typ {
+	case "DOMAIN":
+		domain := normalizeDomain(r.value)
+		r.match = func(t *ruleTarget) bool {
+			return normalizeDomain(t.host) == domain
+		}
+	case "DOMAIN-SUFFIX":
+		suffix := normalizeDomain(r.value)
+		r.match = func(t *ruleTarget) bool {
+			host := normalizeDomain(t.host)
+			return host == suffix || strings.HasSuffix(host, "."+suffix)
+		}
+	case "DOMAIN-KEYWORD":
+		keyword := strings.ToLower(r.value)
+		r.match = func(t *ruleTarget) bool {
+			return strings.Contains(normalizeDomain(t.host), keyword)
+		}
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(r.value)
+		if err != nil {
+			return err
+		}
+		r.match = func(t *ruleTarget) bool {
+			return re.MatchString(normalizeDomain(t.host))
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		nets, err := parseCIDRs([]string{r.value})
+		if err != nil {
+			return err
+		}
+		r.match = r.matchIP(func(ip net.IP) bool {
+			return nets[0].Contains(ip)
+		})
+	case "GEOIP":
+		country := strings.ToUpper(r.value)
+		if db, ok := sources.geoIP[country]; ok {
+			r.match = r.matchIP(db.contains)
+			break
+		}
+		p := sources.provider(ruleProviderGeoIP)
+		// a provider fetched from a URL may not be loaded yet, its countries
+		// are only known once it is
+		if p == nil || p.loaded() && p.geoIP(country) == nil {
+			return fmt.Errorf("unsupported GEOIP country %q", r.value)
+		}
+		r.match = r.matchIP(func(ip net.IP) bool {
+			return p.geoIP(country).contains(ip)
+		})
+	case "GEOSITE":
+		category, attr, _ := strings.Cut(strings.ToLower(r.value), "@")
+		p := sources.provider(ruleProviderGeoSite)
+		if p == nil || p.loaded() && !p.hasSite(category) {
+			return fmt.Errorf("unknown GEOSITE category %q", category)
+		}
+		r.match = func(t *ruleTarget) bool {
+			return p.matchSite(category, attr, t.host)
+		}
+	case "RULE-SET":
+		p := sources.namedProvider(r.value)
+		if p == nil || (p.format != ruleProviderGFWList && p.format != ruleProviderDnsmasq) {
+			return fmt.Errorf("unknown domain rule provider %q", r.value)
+		}
+		r.match = func(t *ruleTarget) bool {
+			return p.matchDomain(t.host)
+		}
+	case "DST-PORT":
+		low, high, err := parsePortRange(r.value)
+		if err != nil {
+			return err
+		}
+		r.match = func(t *ruleTarget) bool {
+			return t.port >= low && t.port <= high
+		}
+	case "SRC-IP", "SRC-IP-CIDR":
+		nets, err := parseCIDRs([]string{r.value})
+		if err != nil {
+			return err
+		}
+		r.match = func(t *ruleTarget) bool {
+			return t.srcIP != nil && nets[0].Contains(t.srcIP)
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", r.typ)
+	}
+	return nil
+}
+
+// matchIP matches the target when host is an IP address, or when any of its
+// addresses matches unless the rule is no-resolve.
+func (r *rule) matchIP(contains func(ip net.IP) bool) func(t *ruleTarget) bool {
+	return func(t *ruleTarget) bool {
+		if ip := net.ParseIP(t.host); ip != nil {
+			return contains(ip)
+		}
+		if r.noResolve || t.noResolve {
+			return false
+		}
+		for _, ip := range t.targetIPs() {
+			if contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// parsePortRange accepts a single port or a range such as 8000-8999.
+func parsePortRange(value string) (int, int, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	low, err := strconv.Atoi(from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.Atoi(to); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", value)
+		}
+	}
+	if low < 0 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return low, high, nil
+}
+
+func normalizeDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// match returns the first rule matching t, or nil.
+func (rules ruleSet) match(t *ruleTarget) *rule {
+	for _, r := range rules {
+		if r.match(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *rule) String() string {
+	if r.typ == "MATCH" {
+		return fmt.Sprintf("MATCH,%s", r.action.name)
+	}
+	return fmt.Sprintf("%s,%s,%s", r.typ, r.value, r.action.name)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRules(t *testing.T, lines ...string) (ruleSet, error) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	require.Nil(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+
+	hk := newTestRemoteProxyClient(t, "hk", "https://hk.example.com")
+	jp := newTestRemoteProxyClient(t, "jp", "https://jp.example.com")
+	dialers := map[string]tunnelDialer{"hk": hk, "jp": jp}
+	sources := &ruleSources{geoIP: map[string]*iPRangeDB{"LAN": privateIPRange}}
+	return loadRules(path, dialers, hk, sources)
+}
+
+func matchRule(rules ruleSet, src, host string, port int, ips ...string) string {
+	target := &ruleTarget{
+		srcIP: net.ParseIP(src),
+		host:  host,
+		port:  port,
+		resolve: func(string) ([]net.IP, <-chan []net.IP) {
+			return parseIPs(ips...), nil
+		},
+	}
+	if r := rules.match(target); r != nil {
+		return r.action.name
+	}
+	return ""
+}
+
+func TestRules(t *testing.T) {
+	rules, err := newTestRules(t,
+		"# comment",
+		"DOMAIN,www.example.com,REJECT",
+		"DOMAIN-SUFFIX,google.com,REMOTE:jp",
+		"DOMAIN-KEYWORD,baidu,DIRECT",
+		`DOMAIN-REGEX,^ads?\.,REJECT`,
+		"",
+		"SRC-IP,192.168.1.100,DIRECT",
+		"DST-PORT,6881-6889,DIRECT",
+		"IP-CIDR,8.8.8.0/24,REMOTE,no-resolve",
+		"IP-CIDR,1.1.1.0/24,REMOTE:jp",
+		"GEOIP,LAN,DIRECT",
+		"MATCH,REMOTE",
+	)
+	require.Nil(t, err)
+	require.Len(t, rules, 10)
+
+	require.Equal(t, "REJECT", matchRule(rules, "", "WWW.example.com.", 443))
+	require.Equal(t, "REMOTE", matchRule(rules, "", "example.com", 443))
+	require.Equal(t, "REMOTE:jp", matchRule(rules, "", "mail.google.com", 443))
+	require.Equal(t, "REMOTE", matchRule(rules, "", "notgoogle.com", 443))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "www.baidu.com", 443))
+	require.Equal(t, "REJECT", matchRule(rules, "", "ad.example.org", 443))
+	require.Equal(t, "DIRECT", matchRule(rules, "192.168.1.100", "www.youtube.com", 443))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "tracker.example.org", 6881))
+	require.Equal(t, "REMOTE", matchRule(rules, "", "8.8.8.8", 53))
+	require.Equal(t, "REMOTE:jp", matchRule(rules, "", "one.one.one.one", 443, "1.1.1.1"))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "router.lan", 80, "192.168.1.1"))
+	require.Equal(t, "DIRECT", matchRule(rules, "", "::1", 80))
+}
+
+func TestRulesResolveOnlyWhenNeeded(t *testing.T) {
+	rules, err := newTestRules(t,
+		"DOMAIN-SUFFIX,google.com,REMOTE",
+		"IP-CIDR,8.8.8.0/24,REMOTE,no-resolve",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+	)
+	require.Nil(t, err)
+
+	resolved := 0
+	target := &ruleTarget{host: "www.google.com", resolve: func(string) ([]net.IP, <-chan []net.IP) {
+		resolved++
+		return nil, nil
+	}}
+	require.NotNil(t, rules.match(target))
+	require.Equal(t, 0, resolved)
+
+	target.host = "www.example.com"
+	require.Nil(t, rules.match(target))
+	require.Equal(t, 1, resolved)
+}
+
+func TestRulesInvalid(t *testing.T) {
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,PROXY",
+		"DOMAIN,example.com,REMOTE:sg",
+		"DOMAIN,example.com,DIRECT:hk",
+		"DOMAIN-REGEX,(,DIRECT",
+		"IP-CIDR,1.1.1.1/33,DIRECT",
+		"IP-CIDR,1.1.1.0/24,DIRECT,resolve",
+		"GEOIP,US,DIRECT",
+		"DST-PORT,70000,DIRECT",
+		"DST-PORT,90-80,DIRECT",
+		"MATCH,DIRECT,extra",
+		"PROCESS-NAME,curl,DIRECT",
+	} {
+		_, err := newTestRules(t, line)
+		require.NotNil(t, err, line)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// hostSniffTimeout bounds how long we wait for the client to speak
+	// first. Protocols where the server speaks first (SSH, SMTP, ...) pay
+	// this delay once per connection.
+	hostSniffTimeout = 500 * time.Millisecond
+
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 16384
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtServerName        = 0x0000
+
+	httpMaxHeaderLen = 8192
+)
+
+// sniffHost reads the first bytes sent by the client and extracts the host
+// name from a TLS ClientHello (SNI) or from the Host header of a plain HTTP
+// request. It returns an empty host if neither is found. The returned
+// connection replays everything that was read, so it can be used in place
+// of conn.
+func sniffHost(conn net.Conn) (string, net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(hostSniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf []byte
+	chunk := make([]byte, 2048)
+	host := ""
+	for len(buf) < tlsRecordHeaderLen+tlsMaxRecordLen {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		var complete bool
+		if host, complete = parseHost(buf); complete || err != nil {
+			break
+		}
+	}
+
+	if len(buf) == 0 {
+		return host, conn
+	}
+	return host, &bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(buf), conn)}
+}
+
+// parseHost extracts the host name from the beginning of a client stream.
+// complete reports whether buf holds enough data to make a decision.
+func parseHost(buf []byte) (host string, complete bool) {
+	if len(buf) == 0 {
+		return "", false
+	}
+	if buf[0] == tlsRecordTypeHandshake {
+		return parseTLSServerName(buf)
+	}
+	if buf[0] >= 'A' && buf[0] <= 'Z' {
+		return parseHTTPHost(buf)
+	}
+	return "", true
+}
+
+func parseTLSServerName(buf []byte) (string, bool) {
+	if len(buf) < tlsRecordHeaderLen {
+		return "", false
+	}
+	recordLen := int(binary.BigEndian.Uint16(buf[3:5]))
+	if len(buf) < tlsRecordHeaderLen+recordLen {
+		return "", false
+	}
+	return serverNameFromClientHello(buf[tlsRecordHeaderLen : tlsRecordHeaderLen+recordLen]), true
+}
+
+// serverNameFromClientHello walks a handshake message as laid out in
+// RFC 8446 section 4.1.2 and returns the server_name extension, if any.
+func serverNameFromClientHello(msg []byte) string {
+	r := tlsReader(msg)
+	typ, ok := r.uint8()
+	if !ok || typ != tlsHandshakeClientHello {
+		return ""
+	}
+	body, ok := r.vector(3)
+	if !ok {
+		return ""
+	}
+
+	r = tlsReader(body)
+	if !r.skip(2 + 32) { // legacy_version, random
+		return ""
+	}
+	if _, ok = r.vector(1); !ok { // legacy_session_id
+		return ""
+	}
+	if _, ok = r.vector(2); !ok { // cipher_suites
+		return ""
+	}
+	if _, ok = r.vector(1); !ok { // legacy_compression_methods
+		return ""
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return ""
+	}
+
+	r = tlsReader(extensions)
+	for len(r) > 0 {
+		extType, ok := r.uint16()
+		if !ok {
+			return ""
+		}
+		data, ok := r.vector(2)
+		if !ok {
+			return ""
+		}
+		if extType != tlsExtServerName {
+			continue
+		}
+
+		d := tlsReader(data)
+		names, ok := d.vector(2)
+		if !ok {
+			return ""
+		}
+		n := tlsReader(names)
+		for len(n) > 0 {
+			nameType, ok := n.uint8()
+			if !ok {
+				return ""
+			}
+			name, ok := n.vector(2)
+			if !ok {
+				return ""
+			}
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+func parseHTTPHost(buf []byte) (string, bool) {
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(buf) >= httpMaxHeaderLen {
+			return "", true
+		}
+		return "", false
+	}
+
+	lines := strings.Split(string(buf[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]"), true
+	}
+	return "", true
+}
+
+// tlsReader consumes big-endian integers and length-prefixed vectors.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a vector whose length is encoded in lenBytes bytes.
+func (r *tlsReader) vector(lenBytes int) ([]byte, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*r = (*r)[lenBytes:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffHostTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "www.example.com"}).Handshake()
+		client.Close()
+	}()
+
+	host, conn := sniffHost(server)
+	require.Equal(t, "www.example.com", host)
+
+	// the ClientHello is replayed to whoever reads conn next
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, byte(tlsRecordTypeHandshake), buf[0])
+}
+
+func TestSniffHostHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	request := "GET / HTTP/1.1\r\nHost: www.example.com:8080\r\nAccept: */*\r\n\r\n"
+	go func() {
+		client.Write([]byte(request))
+	}()
+
+	host, conn := sniffHost(server)
+	require.Equal(t, "www.example.com", host)
+
+	buf := make([]byte, len(request))
+	_, err := io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, request, string(buf))
+	client.Close()
+}
+
+func TestSniffHostUnknownProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		client.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	}()
+
+	host, _ := sniffHost(server)
+	require.Equal(t, "", host)
+}
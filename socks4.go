@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+
+	socks4RepGranted  = 0x5a
+	socks4RepRejected = 0x5b
+
+	// socks4MaxFieldLen bounds the NUL terminated USERID and SOCKS4a domain
+	// fields so a misbehaving client cannot make us buffer forever.
+	socks4MaxFieldLen = 255
+)
+
+// socks4Server accepts SOCKS4 and SOCKS4a clients. SOCKS4 has no notion of
+// passwords, so clients are rejected when the local proxy has users.
+type socks4Server struct {
+	proxy localProxyProvider
+}
+
+func (s *socks4Server) serveConn(client net.Conn) {
+	proxy := s.proxy.current()
+	defer proxy.tunnels.accept(client)()
+	if len(proxy.users) > 0 {
+		log.Printf("deny socks4 client %s", client.RemoteAddr())
+		s.reply(client, socks4RepRejected)
+		client.Close()
+		return
+	}
+
+	host, port, err := s.readRequest(client)
+	if err != nil {
+		log.Printf("socks4 read request from %s error: %v", client.RemoteAddr(), err)
+		s.reply(client, socks4RepRejected)
+		client.Close()
+		return
+	}
+
+	target, err := proxy.connect(client.RemoteAddr().String(), host, port)
+	if err != nil {
+		log.Printf("socks4 connect %s error: %v", net.JoinHostPort(host, port), err)
+		s.reply(client, socks4RepRejected)
+		client.Close()
+		return
+	}
+
+	if err := s.reply(client, socks4RepGranted); err != nil {
+		client.Close()
+		target.Close()
+		return
+	}
+
+	proxy.tunnels.relay(client, target)
+}
+
+func (s *socks4Server) readRequest(client net.Conn) (host, port string, err error) {
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(client, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks4Version {
+		return "", "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	if header[1] != socks4CmdConnect {
+		return "", "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4])))
+	ip := net.IP(header[4:8])
+
+	if _, err = readNulTerminated(client); err != nil {
+		return "", "", fmt.Errorf("read user id error: %v", err)
+	}
+
+	// SOCKS4a: an address of 0.0.0.x with x != 0 means the domain name
+	// follows the user id.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNulTerminated(client); err != nil {
+			return "", "", fmt.Errorf("read domain error: %v", err)
+		}
+		return host, port, nil
+	}
+
+	return ip.String(), port, nil
+}
+
+// readNulTerminated reads one byte at a time so that nothing after the NUL
+// terminator is consumed from the underlying connection.
+func readNulTerminated(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for len(buf) <= socks4MaxFieldLen {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", fmt.Errorf("field longer than %d bytes", socks4MaxFieldLen)
+}
+
+func (s *socks4Server) reply(client net.Conn, rep byte) error {
+	_, err := client.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAtypNotSupported    = 0x08
+	socks5RepAuthFailure         = 0x01
+	socks5RepPasswordAuthSuccess = 0x00
+)
+
+var errSocks5AtypNotSupported = errors.New("address type not supported")
+
+// socks5Server accepts SOCKS5 clients (RFC 1928) and hands every CONNECT
+// to the local proxy, so SOCKS5 traffic is routed exactly like HTTP traffic.
+type socks5Server struct {
+	proxy localProxyProvider
+}
+
+func (s *socks5Server) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *socks5Server) serveConn(client net.Conn) {
+	proxy := s.proxy.current()
+	defer proxy.tunnels.accept(client)()
+	if err := s.negotiate(client, proxy.users); err != nil {
+		log.Printf("socks5 negotiate with %s error: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	host, port, err := s.readRequest(client)
+	if err != nil {
+		log.Printf("socks5 read request from %s error: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	target, err := proxy.connect(client.RemoteAddr().String(), host, port)
+	if err != nil {
+		log.Printf("socks5 connect %s error: %v", net.JoinHostPort(host, port), err)
+		if errors.Is(err, errRejected) || errors.Is(err, errBlocked) {
+			s.reply(client, socks5RepNotAllowed)
+		} else {
+			s.reply(client, socks5RepHostUnreachable)
+		}
+		client.Close()
+		return
+	}
+
+	if err := s.reply(client, socks5RepSucceeded); err != nil {
+		client.Close()
+		target.Close()
+		return
+	}
+
+	proxy.tunnels.relay(client, target)
+}
+
+// negotiate performs method selection and, when the local proxy has users,
+// the username/password sub-negotiation of RFC 1929.
+func (s *socks5Server) negotiate(client net.Conn, users userDB) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return err
+	}
+
+	want := byte(socks5AuthNone)
+	if len(users) > 0 {
+		want = socks5AuthPassword
+	}
+
+	accepted := false
+	for _, m := range methods {
+		if m == want {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		client.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return errors.New("no acceptable authentication method")
+	}
+
+	if _, err := client.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+
+	if want == socks5AuthPassword {
+		return s.authenticate(client, users)
+	}
+	return nil
+}
+
+func (s *socks5Server) authenticate(client net.Conn, users userDB) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return err
+	}
+	if header[0] != socks5PasswordVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(client, username); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(client, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(client, password); err != nil {
+		return err
+	}
+
+	if !users.verify(string(username), string(password)) {
+		client.Write([]byte{socks5PasswordVersion, socks5RepAuthFailure})
+		return fmt.Errorf("invalid credentials for user %q", username)
+	}
+
+	_, err := client.Write([]byte{socks5PasswordVersion, socks5RepPasswordAuthSuccess})
+	return err
+}
+
+func (s *socks5Server) readRequest(client net.Conn) (host, port string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(client, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5Version {
+		return "", "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		s.reply(client, socks5RepCmdNotSupported)
+		return "", "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	if host, err = readSocks5Addr(client, header[3]); err != nil {
+		if err == errSocks5AtypNotSupported {
+			s.reply(client, socks5RepAtypNotSupported)
+		}
+		return "", "", err
+	}
+
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(client, buf); err != nil {
+		return "", "", err
+	}
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(buf)))
+
+	return host, port, nil
+}
+
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case socks5AtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		return string(domain), nil
+	default:
+		return "", errSocks5AtypNotSupported
+	}
+}
+
+// reply writes a reply with an unspecified bind address; clients only use
+// it for BIND and UDP ASSOCIATE, which are not supported.
+func (s *socks5Server) reply(client net.Conn, rep byte) error {
+	_, err := client.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
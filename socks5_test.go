@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func newTestSocks5Server(t *testing.T, username, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &socks5Server{
+		proxy: &localProxyServer{
+			chinaIPRangeDB: newChinaIPRangeDB(),
+			users:          userDB{username: password},
+		},
+	}
+	go s.serve(l)
+	return l
+}
+
+func TestSocks5Connect(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	socks := newTestSocks5Server(t, "user", "pass")
+	defer socks.Close()
+
+	conn, err := net.Dial("tcp", socks.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf[:2])
+	require.Nil(t, err)
+	require.Equal(t, []byte{socks5Version, socks5AuthPassword}, buf[:2])
+
+	conn.Write(append(append([]byte{socks5PasswordVersion, 4}, "user"...), append([]byte{4}, "pass"...)...))
+	_, err = io.ReadFull(conn, buf[:2])
+	require.Nil(t, err)
+	require.Equal(t, []byte{socks5PasswordVersion, socks5RepPasswordAuthSuccess}, buf[:2])
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, byte(socks5RepSucceeded), buf[1])
+
+	conn.Write([]byte("ping"))
+	_, err = io.ReadFull(conn, buf[:4])
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf[:4]))
+}
+
+func TestSocks5RejectsInvalidPassword(t *testing.T) {
+	socks := newTestSocks5Server(t, "user", "pass")
+	defer socks.Close()
+
+	conn, err := net.Dial("tcp", socks.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+
+	conn.Write(append(append([]byte{socks5PasswordVersion, 4}, "user"...), append([]byte{5}, "wrong"...)...))
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, []byte{socks5PasswordVersion, socks5RepAuthFailure}, buf)
+}
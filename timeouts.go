@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTimeouts are the timeouts and the TCP keepalive period of the
+// connections the proxies open. The zero value has no timeouts and the
+// keepalive of the system.
+type connTimeouts struct {
+	dial         time.Duration
+	tlsHandshake time.Duration
+	idle         time.Duration
+	keepAlive    time.Duration
+
+	// counts, if not nil, counts the dials and TLS handshakes that timed
+	// out.
+	counts *timeoutCounts
+}
+
+// newConnTimeouts converts the values of the timeout flags, in seconds, where
+// 0 means no timeout and no keepalive.
+func newConnTimeouts(dialSeconds, tlsHandshakeSeconds, idleSeconds, keepAliveSeconds int) connTimeouts {
+	keepAlive := time.Duration(keepAliveSeconds) * time.Second
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+	return connTimeouts{
+		dial:         time.Duration(dialSeconds) * time.Second,
+		tlsHandshake: time.Duration(tlsHandshakeSeconds) * time.Second,
+		idle:         time.Duration(idleSeconds) * time.Second,
+		keepAlive:    keepAlive,
+	}
+}
+
+func (t connTimeouts) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: t.dial, KeepAlive: t.keepAlive}
+}
+
+// dialContext is the DialContext of dialer, counting the dials that time
+// out.
+func (t connTimeouts) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := t.dialer().DialContext(ctx, network, addr)
+	t.countDial(addr, err)
+	return conn, err
+}
+
+// countDial counts the dial of addr if it failed with a timeout.
+func (t connTimeouts) countDial(addr string, err error) {
+	if t.counts != nil && isTimeout(err) {
+		n := t.counts.dial.Add(1)
+		log.Printf("dial %s timed out, %d dials timed out so far", addr, n)
+	}
+}
+
+// dialTLS connects to addr and completes the TLS handshake, each within its
+// own timeout.
+func (t connTimeouts) dialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	rawConn, err := t.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if t.tlsHandshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.tlsHandshake)
+		defer cancel()
+	}
+	conn := tls.Client(rawConn, cfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		t.counts.countTLSHandshake(addr, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// closeIdle returns conn closed once no byte has been read or written on it
+// for the idle timeout, for the connections that are not relayed as
+// tunnels, such as those of forwarded plain HTTP requests.
+func (t connTimeouts) closeIdle(conn net.Conn) net.Conn {
+	if t.idle <= 0 {
+		return conn
+	}
+	watch := newIdleWatch(t.idle, func() {
+		conn.Close()
+	})
+	return &idleClosingConn{Conn: watch.conn(conn), watch: watch}
+}
+
+type idleClosingConn struct {
+	net.Conn
+	watch *idleWatch
+}
+
+func (c *idleClosingConn) Close() error {
+	c.watch.stop()
+	return c.Conn.Close()
+}
+
+// timeoutCounts counts the connections given up on for each timeout.
+type timeoutCounts struct {
+	dial         atomic.Uint64
+	tlsHandshake atomic.Uint64
+	idle         atomic.Uint64
+}
+
+// countTLSHandshake counts the TLS handshake with addr if it failed with a
+// timeout. A nil timeoutCounts counts nothing.
+func (c *timeoutCounts) countTLSHandshake(addr string, err error) {
+	if c != nil && isTimeout(err) {
+		n := c.tlsHandshake.Add(1)
+		log.Printf("TLS handshake with %s timed out, %d handshakes timed out so far", addr, n)
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// idleWatch closes a tunnel once no byte has been read or written on its
+// connections for the idle timeout, so that tunnels whose peers vanished
+// without a FIN or RST, as is common across the GFW, do not hold their
+// goroutines forever. Traffic only records when it happened; the timer is
+// re-armed for the rest of the timeout when it fires, rather than reset on
+// every read and write. A nil idleWatch never fires.
+type idleWatch struct {
+	timeout time.Duration
+	expire  func()
+	active  atomic.Int64
+	expired atomic.Bool
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+
+	// counted are the connections whose traffic is read from the counters
+	// of the kernel, traffic is their sum when last checked.
+	counted []*net.TCPConn
+	traffic uint64
+}
+
+func newIdleWatch(timeout time.Duration, expire func()) *idleWatch {
+	w := &idleWatch{timeout: timeout, expire: expire}
+	w.touch()
+	w.mu.Lock()
+	w.timer = time.AfterFunc(timeout, w.check)
+	w.mu.Unlock()
+	return w
+}
+
+// conn returns conn with every read and write counting as traffic. A TCP
+// connection whose traffic the kernel counts is returned as is, so that
+// io.Copy can still splice it.
+func (w *idleWatch) conn(conn net.Conn) net.Conn {
+	if w == nil {
+		return conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if traffic, ok := tcpTraffic(tcpConn); ok {
+			w.mu.Lock()
+			w.counted = append(w.counted, tcpConn)
+			w.traffic += traffic
+			w.mu.Unlock()
+			return conn
+		}
+	}
+	return &idleWatchedConn{Conn: conn, watch: w}
+}
+
+func (w *idleWatch) touch() {
+	w.active.Store(time.Now().UnixNano())
+}
+
+func (w *idleWatch) check() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	if len(w.counted) > 0 {
+		var traffic uint64
+		for _, conn := range w.counted {
+			n, _ := tcpTraffic(conn)
+			traffic += n
+		}
+		if traffic != w.traffic {
+			w.traffic = traffic
+			w.touch()
+		}
+	}
+	idle := time.Since(time.Unix(0, w.active.Load()))
+	if idle < w.timeout {
+		w.timer.Reset(w.timeout - idle)
+		w.mu.Unlock()
+		return
+	}
+	w.expired.Store(true)
+	w.mu.Unlock()
+	w.expire()
+}
+
+// stop stops the timer and reports whether the tunnel was closed for being
+// idle.
+func (w *idleWatch) stop() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	w.stopped = true
+	w.timer.Stop()
+	w.mu.Unlock()
+	return w.expired.Load()
+}
+
+type idleWatchedConn struct {
+	net.Conn
+	watch *idleWatch
+}
+
+func (c *idleWatchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.watch.touch()
+	}
+	return n, err
+}
+
+func (c *idleWatchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.watch.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpTraffic returns the number of bytes received and acknowledged on conn
+// as counted by the kernel, so that traffic can be observed without reading
+// and writing through a wrapper, which would keep io.Copy from splicing.
+func tcpTraffic(conn *net.TCPConn) (uint64, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || infoErr != nil {
+		return 0, false
+	}
+	return info.Bytes_acked + info.Bytes_received, true
+}
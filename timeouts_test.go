@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnTimeouts(t *testing.T) {
+	timeouts := newConnTimeouts(10, 5, 300, 30)
+	dialer := timeouts.dialer()
+	require.Equal(t, 10*time.Second, dialer.Timeout)
+	require.Equal(t, 30*time.Second, dialer.KeepAlive)
+	require.Equal(t, 5*time.Second, timeouts.tlsHandshake)
+	require.Equal(t, 300*time.Second, timeouts.idle)
+
+	// 0 disables the keepalive instead of falling back to the default
+	require.Less(t, newConnTimeouts(0, 0, 0, 0).dialer().KeepAlive, time.Duration(0))
+}
+
+func TestDialTLSHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		// accept and never answer the ClientHello
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	timeouts := connTimeouts{tlsHandshake: 100 * time.Millisecond, counts: &timeoutCounts{}}
+	start := time.Now()
+	_, err = timeouts.dialTLS(context.Background(), "tcp", listener.Addr().String(), nil)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, uint64(1), timeouts.counts.tlsHandshake.Load())
+}
+
+func TestConnTimeoutsCountDialTimeouts(t *testing.T) {
+	timeouts := connTimeouts{counts: &timeoutCounts{}}
+	timeouts.countDial("192.0.2.1:443", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded})
+	timeouts.countDial("127.0.0.1:1", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})
+	timeouts.countDial("127.0.0.1:443", nil)
+	require.Equal(t, uint64(1), timeouts.counts.dial.Load())
+
+	// without counters nothing is counted
+	connTimeouts{}.countDial("192.0.2.1:443", os.ErrDeadlineExceeded)
+}
+
+func TestIdleWatchObservesTCPTrafficWithoutWrapping(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	server, err := listener.Accept()
+	require.Nil(t, err)
+	defer server.Close()
+
+	expired := make(chan struct{})
+	watch := newIdleWatch(200*time.Millisecond, func() { close(expired) })
+	defer watch.stop()
+	watched := watch.conn(server)
+	if runtime.GOOS == "linux" {
+		// io.Copy can still splice it
+		require.IsType(t, &net.TCPConn{}, watched)
+	}
+
+	// traffic that does not go through watched still counts
+	go io.Copy(io.Discard, watched)
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err := client.Write([]byte("ping"))
+		require.Nil(t, err)
+	}
+	select {
+	case <-expired:
+		t.Fatal("expired with traffic")
+	default:
+	}
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("not expired without traffic")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// tlsListener completes the TLS handshake of every accepted connection
+// within the handshake timeout before handing it out by Accept, so that an
+// http.Server serving it sees finished *tls.Conn. Unlike the server's
+// ReadHeaderTimeout, which keeps running after the handshake until the first
+// request arrives, nothing limits how long a connection may then wait for
+// its request, which the pre-warmed connections of local proxies rely on.
+type tlsListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+	counts  *timeoutCounts
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newTLSListener returns a tlsListener counting the handshakes that time out
+// with counts, which may be nil.
+func newTLSListener(listener net.Listener, config *tls.Config, timeout time.Duration, counts *timeoutCounts) *tlsListener {
+	l := &tlsListener{
+		Listener: listener,
+		config:   config,
+		timeout:  timeout,
+		counts:   counts,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	ctx := context.Background()
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	tlsConn := tls.Server(conn, l.config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		l.counts.countTLSHandshake(conn.RemoteAddr().String(), err)
+		return
+	}
+
+	select {
+	case l.conns <- tlsConn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSListenerBoundsOnlyTheHandshake(t *testing.T) {
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{
+		Certificates: certs.TLS.Certificates,
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+	}
+	certs.Close()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener := newTLSListener(raw, config, 200*time.Millisecond, nil)
+	server := &http.Server{
+		TLSConfig: config,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(rw, req.Proto)
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	addr := raw.Addr().String()
+
+	// a client that never starts the handshake is dropped
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), time.Second)
+
+	// a connection may wait for its first request long after the handshake,
+	// like a pooled connection of a local proxy
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	require.Nil(t, err)
+	defer tlsConn.Close()
+	time.Sleep(600 * time.Millisecond)
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// HTTP/2 is still negotiated
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err = client.Get("https://" + addr + "/")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, 2, res.ProtoMajor)
+}
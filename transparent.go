@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// transparentServer accepts TCP connections that netfilter REDIRECT'ed to
+// it, e.g. from devices on a LAN that use this box as their gateway. The
+// original destination is recovered with SO_ORIGINAL_DST and the host name
+// is sniffed from the first bytes the client sends, so such connections are
+// routed like any proxied request.
+type transparentServer struct {
+	proxy localProxyProvider
+}
+
+func (s *transparentServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *transparentServer) serveConn(client net.Conn) {
+	proxy := s.proxy.current()
+	defer proxy.tunnels.accept(client)()
+	dst, err := originalDst(client)
+	if err != nil {
+		log.Printf("get original destination of %s error: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	// a fake IP already tells the domain, there is no need to sniff it
+	var host string
+	if !proxy.fakeIPs.contains(dst.IP) {
+		host, client = sniffHost(client)
+	}
+	port := strconv.Itoa(dst.Port)
+
+	target, err := proxy.connectSniffed(client.RemoteAddr().String(), host, dst.IP, port)
+	if err != nil {
+		log.Printf("transparent connect %s(%s) error: %v", dst, host, err)
+		client.Close()
+		return
+	}
+
+	proxy.tunnels.relay(client, target)
+}
+
+// reservedIPv4Ranges and reservedIPv6Ranges are never redirected in addition
+// to privateIPRange: they are either local to the link or not routable.
+var (
+	reservedIPv4Ranges = []string{"0.0.0.0/8", "100.64.0.0/10", "169.254.0.0/16", "224.0.0.0/4", "240.0.0.0/4"}
+	reservedIPv6Ranges = []string{"fe80::/10", "ff00::/8"}
+)
+
+// nftablesRules returns an nftables ruleset that REDIRECTs TCP traffic
+// forwarded by this box to the transparent listener on port, leaving
+// private and reserved destinations alone.
+func nftablesRules(port int) string {
+	var v4, v6 []string
+	for _, r := range privateIPRange.db {
+		if strings.Contains(r.value, ":") {
+			v6 = append(v6, r.value)
+		} else {
+			v4 = append(v4, r.value)
+		}
+	}
+	v4 = append(v4, reservedIPv4Ranges...)
+	v6 = append(v6, reservedIPv6Ranges...)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Redirect TCP traffic forwarded by this box to the transparent proxy on port %d.\n", port)
+	fmt.Fprintf(&b, "# Apply with: nft -f <file>\n")
+	fmt.Fprintf(&b, "table inet sandwich\n")
+	fmt.Fprintf(&b, "delete table inet sandwich\n\n")
+	fmt.Fprintf(&b, "table inet sandwich {\n")
+	fmt.Fprintf(&b, "\tchain prerouting {\n")
+	fmt.Fprintf(&b, "\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tfib daddr type local return\n")
+	fmt.Fprintf(&b, "\t\tip daddr { %s } return\n", strings.Join(v4, ", "))
+	fmt.Fprintf(&b, "\t\tip6 daddr { %s } return\n", strings.Join(v6, ", "))
+	fmt.Fprintf(&b, "\t\tmeta l4proto tcp redirect to :%d\n", port)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
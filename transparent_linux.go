@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+)
+
+// originalDst returns the destination a REDIRECT'ed connection was
+// originally addressed to, as recorded by netfilter's conntrack.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			var mreq *syscall.IPv6Mreq
+			// sockaddr_in fits in the 16 bytes of IPv6Mreq.Multiaddr.
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sockErr != nil {
+				return
+			}
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+			}
+			return
+		}
+
+		var info *syscall.IPv6MTUInfo
+		// sockaddr_in6 is the first field of ip6_mtuinfo.
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst); sockErr != nil {
+			return
+		}
+		// The port is stored in network byte order.
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		addr = &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return addr, nil
+}
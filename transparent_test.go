@@ -0,0 +1,15 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNftablesRules(t *testing.T) {
+	rules := nftablesRules(5687)
+	require.True(t, strings.Contains(rules, "meta l4proto tcp redirect to :5687"))
+	require.True(t, strings.Contains(rules, "192.168.0.0/16"))
+	require.True(t, strings.Contains(rules, "fc00::/7"))
+}
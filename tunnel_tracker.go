@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelTracker keeps the connections of the tunnels in flight, from the
+// moment their client is accepted, so that a shutdown can wait for them to
+// finish and close the ones that outlive the drain timeout. Tunnels idle for longer than the idle timeout, if any, are
+// closed and counted, as are the dials and TLS handshakes that time out. A
+// nil tunnelTracker tracks nothing.
+type tunnelTracker struct {
+	mu      sync.Mutex
+	tunnels map[*trackedTunnel]struct{}
+
+	// accepted are the client connections accepted and not done with yet,
+	// whether relayed or still being negotiated, sniffed, resolved or
+	// dialed.
+	accepted map[*acceptedConn]struct{}
+
+	idleTimeout atomic.Int64
+	timedOut    timeoutCounts
+}
+
+type trackedTunnel struct {
+	client net.Conn
+	target net.Conn
+}
+
+type acceptedConn struct {
+	client net.Conn
+}
+
+func newTunnelTracker(idleTimeout time.Duration) *tunnelTracker {
+	t := &tunnelTracker{
+		tunnels:  make(map[*trackedTunnel]struct{}),
+		accepted: make(map[*acceptedConn]struct{}),
+	}
+	t.setIdleTimeout(idleTimeout)
+	return t
+}
+
+// setIdleTimeout changes the idle timeout of the tunnels relayed from now
+// on, 0 means no timeout.
+func (t *tunnelTracker) setIdleTimeout(timeout time.Duration) {
+	t.idleTimeout.Store(int64(timeout))
+}
+
+// accept registers client as soon as it is accepted, before it has a
+// target, and returns the func to call once it is done with. client may be
+// nil for a request still owned by the HTTP server, which closes it itself,
+// so that it is only waited for.
+func (t *tunnelTracker) accept(client net.Conn) (done func()) {
+	if t == nil {
+		return func() {}
+	}
+	c := &acceptedConn{client: client}
+	t.mu.Lock()
+	t.accepted[c] = struct{}{}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.accepted, c)
+		t.mu.Unlock()
+	}
+}
+
+// relay copies between client and target in both directions and returns
+// once the tunnel is done, with both connections closed.
+func (t *tunnelTracker) relay(client, target net.Conn) {
+	if t != nil {
+		tunnel := &trackedTunnel{client: client, target: target}
+		t.mu.Lock()
+		t.tunnels[tunnel] = struct{}{}
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.tunnels, tunnel)
+			t.mu.Unlock()
+		}()
+
+		watch := t.watchIdle(func() {
+			client.Close()
+			target.Close()
+		})
+		defer func() {
+			if watch.stop() {
+				t.countIdleTimedOut(client.RemoteAddr().String(), target.RemoteAddr().String(), watch.timeout)
+			}
+		}()
+		client, target = watch.conn(client), watch.conn(target)
+	}
+
+	go transfer(client, target)
+	transfer(target, client)
+}
+
+// watchIdle returns an idleWatch calling expire after the idle timeout, or
+// nil if there is no timeout.
+func (t *tunnelTracker) watchIdle(expire func()) *idleWatch {
+	if t == nil {
+		return nil
+	}
+	timeout := time.Duration(t.idleTimeout.Load())
+	if timeout <= 0 {
+		return nil
+	}
+	return newIdleWatch(timeout, expire)
+}
+
+// countIdleTimedOut records a tunnel closed by its idleWatch.
+func (t *tunnelTracker) countIdleTimedOut(from, to string, timeout time.Duration) {
+	n := t.timedOut.idle.Add(1)
+	log.Printf("tunnel %s <-> %s idle for %s, closed, %d idle tunnels closed so far", from, to, timeout, n)
+}
+
+// timeoutCounts returns the counters that connTimeouts count the timed out
+// dials and TLS handshakes with.
+func (t *tunnelTracker) timeoutCounts() *timeoutCounts {
+	if t == nil {
+		return nil
+	}
+	return &t.timedOut
+}
+
+type tunnelStats struct {
+	Active               int    `json:"active"`
+	IdleTimedOut         uint64 `json:"idle_timed_out"`
+	DialTimedOut         uint64 `json:"dial_timed_out"`
+	TLSHandshakeTimedOut uint64 `json:"tls_handshake_timed_out"`
+}
+
+func (t *tunnelTracker) stats() tunnelStats {
+	return tunnelStats{
+		Active:               t.active(),
+		IdleTimedOut:         t.timedOut.idle.Load(),
+		DialTimedOut:         t.timedOut.dial.Load(),
+		TLSHandshakeTimedOut: t.timedOut.tlsHandshake.Load(),
+	}
+}
+
+// active returns the number of tunnels in flight.
+func (t *tunnelTracker) active() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels)
+}
+
+// inFlight reports whether any tunnel is relayed or any client accepted is
+// not done with yet.
+func (t *tunnelTracker) inFlight() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels) > 0 || len(t.accepted) > 0
+}
+
+// drain waits for the tunnels in flight and the clients accepted to finish.
+// When ctx is done first, the remaining connections are closed and ctx.Err()
+// is returned.
+func (t *tunnelTracker) drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for t.inFlight() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.closeAll()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *tunnelTracker) closeAll() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tunnel := range t.tunnels {
+		tunnel.client.Close()
+		tunnel.target.Close()
+	}
+	for c := range t.accepted {
+		if c.client != nil {
+			c.client.Close()
+		}
+	}
+}
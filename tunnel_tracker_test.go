@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelTrackerDrainWaitsForTunnels(t *testing.T) {
+	tracker := newTunnelTracker(0)
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		tracker.relay(clientPeer, targetPeer)
+		close(done)
+	}()
+
+	go func() {
+		client.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	_, err := target.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf))
+	require.Equal(t, 1, tracker.active())
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- tracker.drain(context.Background())
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a tunnel in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.Close()
+	target.Close()
+	require.Nil(t, <-drained)
+	<-done
+	require.Equal(t, 0, tracker.active())
+}
+
+func TestTunnelTrackerDrainClosesTunnelsOnTimeout(t *testing.T) {
+	tracker := newTunnelTracker(0)
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+	done := make(chan struct{})
+	go func() {
+		tracker.relay(clientPeer, targetPeer)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return tracker.active() == 1 }, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, tracker.drain(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay still running after drain timed out")
+	}
+	require.Equal(t, 0, tracker.active())
+}
+
+func TestTunnelTrackerClosesIdleTunnels(t *testing.T) {
+	tracker := newTunnelTracker(200 * time.Millisecond)
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+	done := make(chan struct{})
+	go func() {
+		tracker.relay(clientPeer, targetPeer)
+		close(done)
+	}()
+
+	// traffic resets the idle timer
+	buf := make([]byte, 4)
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		go client.Write([]byte("ping"))
+		_, err := target.Read(buf)
+		require.Nil(t, err)
+	}
+	require.Equal(t, 1, tracker.active())
+	require.Equal(t, uint64(0), tracker.stats().IdleTimedOut)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+	require.Equal(t, tunnelStats{Active: 0, IdleTimedOut: 1}, tracker.stats())
+}
+
+func TestTunnelTrackerDrainsClientsNotRelayedYet(t *testing.T) {
+	tracker := newTunnelTracker(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	s := &socks5Server{proxy: &localProxyServer{chinaIPRangeDB: newChinaIPRangeDB(), tunnels: tracker}}
+	go s.serve(l)
+
+	// the client stalls in the middle of the negotiation
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte{socks5Version})
+	require.Eventually(t, tracker.inFlight, time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, tracker.active())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, tracker.drain(ctx), context.DeadlineExceeded)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Eventually(t, func() bool { return !tracker.inFlight() }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The v2ray geosite.dat and geoip.dat files are protobuf messages:
+//
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	message Attribute { string key = 1; ... }
+//
+//	message GeoIPList { repeated GeoIP entry = 1; }
+//	message GeoIP { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+//	message CIDR { bytes ip = 1; uint32 prefix = 2; }
+//
+// Only these few fields are needed, so they are decoded by hand instead of
+// pulling in a protobuf runtime.
+
+const (
+	geoSiteDomainPlain  = 0 // keyword
+	geoSiteDomainRegex  = 1
+	geoSiteDomainSuffix = 2
+	geoSiteDomainFull   = 3
+)
+
+type geoSiteDomain struct {
+	typ   uint64
+	value string
+	attrs []string
+}
+
+// parseGeoSiteList returns the domains of every category in geosite.dat,
+// keyed by the lower case category name.
+func parseGeoSiteList(data []byte) (map[string][]geoSiteDomain, error) {
+	sites := make(map[string][]geoSiteDomain)
+	err := protoFields(data, func(num int, _ uint64, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var category string
+		var domains []geoSiteDomain
+		err := protoFields(entry, func(num int, _ uint64, value []byte) error {
+			switch num {
+			case 1:
+				category = strings.ToLower(string(value))
+			case 2:
+				domain, err := parseGeoSiteDomain(value)
+				if err != nil {
+					return err
+				}
+				domains = append(domains, domain)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sites[category] = append(sites[category], domains...)
+		return nil
+	})
+	return sites, err
+}
+
+func parseGeoSiteDomain(data []byte) (geoSiteDomain, error) {
+	var d geoSiteDomain
+	err := protoFields(data, func(num int, v uint64, value []byte) error {
+		switch num {
+		case 1:
+			d.typ = v
+		case 2:
+			d.value = string(value)
+		case 3:
+			return protoFields(value, func(num int, _ uint64, key []byte) error {
+				if num == 1 {
+					d.attrs = append(d.attrs, strings.ToLower(string(key)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return d, err
+}
+
+// newGeoSiteMatcher builds a matcher from the domains of a category. When
+// attr is not empty only the domains carrying that attribute are used.
+func newGeoSiteMatcher(domains []geoSiteDomain, attr string) *domainMatcher {
+	m := newDomainMatcher()
+	for _, d := range domains {
+		if attr != "" && !slices.Contains(d.attrs, attr) {
+			continue
+		}
+		switch d.typ {
+		case geoSiteDomainPlain:
+			m.keywords = append(m.keywords, strings.ToLower(d.value))
+		case geoSiteDomainRegex:
+			if re, err := regexp.Compile(d.value); err == nil {
+				m.regexps = append(m.regexps, re)
+			}
+		case geoSiteDomainSuffix:
+			m.suffixes.add(d.value)
+		case geoSiteDomainFull:
+			m.full[normalizeDomain(d.value)] = struct{}{}
+		}
+	}
+	return m
+}
+
+// parseGeoIPList returns the IP ranges of every country in geoip.dat, keyed
+// by the upper case country code.
+func parseGeoIPList(data []byte) (map[string]*cidrSet, error) {
+	countries := make(map[string]*cidrSet)
+	err := protoFields(data, func(num int, _ uint64, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var country string
+		var nets []*net.IPNet
+		var reverse bool
+		err := protoFields(entry, func(num int, v uint64, value []byte) error {
+			switch num {
+			case 1:
+				country = strings.ToUpper(string(value))
+			case 2:
+				n, err := parseGeoIPCIDR(value)
+				if err != nil {
+					return err
+				}
+				nets = append(nets, n)
+			case 3:
+				reverse = v != 0
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		countries[country] = newCIDRSet(nets, reverse)
+		return nil
+	})
+	return countries, err
+}
+
+func parseGeoIPCIDR(data []byte) (*net.IPNet, error) {
+	var ip net.IP
+	var prefix uint64
+	err := protoFields(data, func(num int, v uint64, value []byte) error {
+		switch num {
+		case 1:
+			ip = net.IP(value)
+		case 2:
+			prefix = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bits := len(ip) * 8
+	if (len(ip) != net.IPv4len && len(ip) != net.IPv6len) || prefix > uint64(bits) {
+		return nil, fmt.Errorf("invalid CIDR %v/%d", ip, prefix)
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoFields calls fn for every field of a protobuf message with its
+// number, and either its varint value or its length-delimited bytes.
+func protoFields(data []byte, fn func(num int, v uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+
+		var v uint64
+		var value []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errProtoTruncated
+			}
+			value = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+
+		if err := fn(int(key>>3), v, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func protoVarint(num int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(num int, values ...[]byte) []byte {
+	var value []byte
+	for _, v := range values {
+		value = append(value, v...)
+	}
+	b := binary.AppendUvarint(nil, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func geoSiteDomainMessage(typ uint64, value string, attrs ...string) []byte {
+	fields := [][]byte{protoVarint(1, typ), protoBytes(2, []byte(value))}
+	for _, attr := range attrs {
+		fields = append(fields, protoBytes(3, protoBytes(1, []byte(attr)), protoVarint(2, 1)))
+	}
+	return protoBytes(2, fields...)
+}
+
+func geoIPCIDRMessage(cidr string) []byte {
+	ip, n, _ := net.ParseCIDR(cidr)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, _ := n.Mask.Size()
+	return protoBytes(2, protoBytes(1, ip), protoVarint(2, uint64(ones)))
+}
+
+func newTestGeoSiteData() []byte {
+	return append(
+		protoBytes(1,
+			protoBytes(1, []byte("GOOGLE")),
+			geoSiteDomainMessage(geoSiteDomainSuffix, "google.com"),
+			geoSiteDomainMessage(geoSiteDomainSuffix, "google.cn", "cn"),
+			geoSiteDomainMessage(geoSiteDomainFull, "www.gstatic.com"),
+			geoSiteDomainMessage(geoSiteDomainPlain, "googleapis"),
+			geoSiteDomainMessage(geoSiteDomainRegex, `^ad[0-9]+\.doubleclick\.net$`),
+		),
+		protoBytes(1,
+			protoBytes(1, []byte("CN")),
+			geoSiteDomainMessage(geoSiteDomainSuffix, "cn"),
+		)...,
+	)
+}
+
+func newTestGeoIPData() []byte {
+	return append(
+		protoBytes(1,
+			protoBytes(1, []byte("jp")),
+			geoIPCIDRMessage("1.0.16.0/20"),
+			geoIPCIDRMessage("2001:200::/23"),
+		),
+		protoBytes(1,
+			protoBytes(1, []byte("not-jp")),
+			geoIPCIDRMessage("1.0.16.0/20"),
+			protoVarint(3, 1),
+		)...,
+	)
+}
+
+func TestParseGeoSiteList(t *testing.T) {
+	sites, err := parseGeoSiteList(newTestGeoSiteData())
+	require.Nil(t, err)
+	require.Len(t, sites, 2)
+	require.Len(t, sites["google"], 5)
+
+	m := newGeoSiteMatcher(sites["google"], "")
+	require.True(t, m.match("mail.google.com"))
+	require.True(t, m.match("google.cn"))
+	require.True(t, m.match("www.gstatic.com"))
+	require.False(t, m.match("img.gstatic.com"))
+	require.True(t, m.match("fonts.googleapis.com"))
+	require.True(t, m.match("ad12.doubleclick.net"))
+	require.False(t, m.match("www.example.com"))
+
+	cn := newGeoSiteMatcher(sites["google"], "cn")
+	require.True(t, cn.match("www.google.cn"))
+	require.False(t, cn.match("www.google.com"))
+
+	_, err = parseGeoSiteList(newTestGeoSiteData()[:10])
+	require.NotNil(t, err)
+}
+
+func TestParseGeoIPList(t *testing.T) {
+	countries, err := parseGeoIPList(newTestGeoIPData())
+	require.Nil(t, err)
+	require.Len(t, countries, 2)
+
+	jp := countries["JP"]
+	require.True(t, jp.contains(net.ParseIP("1.0.16.1")))
+	require.True(t, jp.contains(net.ParseIP("2001:200::1")))
+	require.False(t, jp.contains(net.ParseIP("1.0.32.1")))
+	require.False(t, jp.contains(net.ParseIP("2408::1")))
+
+	notJP := countries["NOT-JP"]
+	require.False(t, notJP.contains(net.ParseIP("1.0.16.1")))
+	require.True(t, notJP.contains(net.ParseIP("8.8.8.8")))
+}